@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig applies the values of the YAML config file at filePath to all flags
+// of fs which were not explicitly set on the command line. The file maps flag names
+// to values, lists are joined with commas:
+//
+//	ignore:
+//	  - configmap:foo
+//	  - service:bar
+//	no-shebang: true
+func loadConfig(fs *flag.FlagSet, filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("unable to read config file at '%v': %v", filePath, err)
+	}
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return fmt.Errorf("unable to parse config file '%v': %v", filePath, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, value := range config {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown flag in config file '%v': %v", filePath, name)
+		}
+		if explicit[name] {
+			continue
+		}
+		if err := fs.Set(name, configValue(value)); err != nil {
+			return fmt.Errorf("invalid value for '%v' in config file '%v': %v", name, filePath, err)
+		}
+	}
+	return nil
+}
+
+func configValue(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return fmt.Sprint(value)
+	}
+	var values []string
+	for _, v := range list {
+		values = append(values, fmt.Sprint(v))
+	}
+	return strings.Join(values, ",")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	config := writeFile(t, dir, "config.yaml", `from: testdata/kyma-1.yaml
+to: testdata/kyma-2.yaml
+ignore:
+  - servicemonitor.monitoring.coreos.com:tracing-jaeger-operator
+  - configmap:tracing-grafana-dashboard
+no-shebang: true
+`)
+
+	t.Run("config values", func(t *testing.T) {
+		output := path.Join(dir, "config.sh")
+		args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", config, "-output", output})
+		require.NoError(t, err)
+		require.NoError(t, run(bytes.NewBufferString(""), args))
+
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		require.Equal(t, `kubectl delete -n kyma-system --ignore-not-found authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete --ignore-not-found podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete --ignore-not-found clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, string(content))
+	})
+
+	t.Run("flags override config", func(t *testing.T) {
+		args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-ignore", "configmap:foo", "-config", config})
+		require.NoError(t, err)
+		require.Equal(t, "configmap:foo", args.ignored)
+		require.Equal(t, "testdata/kyma-1.yaml", args.fromFile)
+		require.True(t, args.noShebang)
+	})
+
+	t.Run("unknown flag", func(t *testing.T) {
+		invalid := writeFile(t, dir, "invalid.yaml", "unknown: true\n")
+		_, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", invalid})
+		require.EqualError(t, err, "unknown flag in config file '"+invalid+"': unknown")
+	})
+}
@@ -3,12 +3,12 @@ module migrate
 go 1.17
 
 require (
+	github.com/gertd/go-pluralize v0.2.1
 	github.com/stretchr/testify v1.7.1
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
-	github.com/gertd/go-pluralize v0.2.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 )
@@ -2,258 +2,2501 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/gertd/go-pluralize"
 	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
 
 	"gopkg.in/yaml.v3"
+	"migrate/manifest"
 )
 
-type kindNameVersion struct {
-	apiVersion string
-	kind       string
-	name       string
+const defaultNamespace = "kyma-system"
+
+// version and commit identify the build, they are set with
+// -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// defaultCommandTemplate renders the deletions as kubectl commands.
+const defaultCommandTemplate = "{{.Command}} {{.Target}}"
+
+const defaultShebang = "#!/usr/bin/env bash"
+
+// Shells the deletion script can be generated for.
+const (
+	shellBash       = "bash"
+	shellPowerShell = "powershell"
+)
+
+// Severities of the resources to be deleted, for triaging the summary.
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
+
+// defaultSeverities maps kinds, qualified by their group, to the severity of deleting their
+// resources. Kinds not listed are of severityInfo.
+var defaultSeverities = map[string]string{
+	"configmap": severityInfo,
+	"customresourcedefinition.apiextensions.k8s.io": severityWarning,
+	"namespace":             severityCritical,
+	"persistentvolume":      severityCritical,
+	"persistentvolumeclaim": severityCritical,
 }
 
-type kindName struct {
-	kind string
-	name string
+const (
+	formatText      = "text"
+	formatJSON      = "json"
+	formatYAML      = "yaml"
+	formatTable     = "table"
+	formatArgoCD    = "argocd"
+	formatNarrative = "narrative"
+)
+
+type kindNamespace struct {
+	kind      string
+	namespace string
 }
 
 type flags struct {
-	fromFile   string
-	toFile     string
-	outputFile string
-	ignored    string
+	fromFile    string
+	toFile      string
+	outputFile  string
+	outputDir   string
+	ignored     string
+	ignoreRegex string
+	ignoreFile  string
+	allowed     string
+
+	createdBefore string
+	maxPerKind    string
+	force         bool
+	failOnEmpty   bool
+	failOnOrphans bool
+	filterCommand string
+
+	withFinalizersOnly    bool
+	deleteKept            bool
+	includeOwned          bool
+	withoutFinalizersOnly bool
+	noShebang             bool
+	shebang               string
+	shell                 string
+	strict                bool
+	reportFailures        bool
+	commandTemplate       string
+	sleep                 time.Duration
+	now                   bool
+	ignoreNotFound        bool
+	gracePeriod           string
+	dryRun                string
+	forceDelete           bool
+	timeout               time.Duration
+	wait                  string
+	namespace             string
+	context               string
+	contextMap            string
+	parseOnly             bool
+	verbose               bool
+	printVersion          bool
+	quiet                 bool
+	showUnchanged         bool
+	kindsReport           bool
+
+	previewResolved bool
+	format          string
+
+	fromConfigMap string
+	toConfigMap   string
+	keepList      string
+
+	summaryFormat string
+
+	reportFile   string
+	severityFile string
+	pruneOutput  string
+	applyOutput  string
+	orderFile    string
+	stdinBatch   bool
+
+	maxLinesPerFile int
+
+	reverse       bool
+	preserveOrder bool
+
+	deleteStatefulSetPVCs bool
+
+	selectorDelete  bool
+	restoreComments bool
+	byUID           bool
+	requireLabel    string
+	functions       bool
+	optimized       bool
+	validateScript  bool
+
+	workloadsBeforeServices bool
+	kindPriority            bool
+
+	emitHeaderEnv bool
+	exitSummary   bool
+
+	includeAnnotations bool
+
+	namespaceLabel string
+
+	normalizeNameRegex       string
+	normalizeNameReplacement string
+
+	safeOnParseWarnings bool
+	onMissingKind       string
 }
 
 func main() {
-	var args = flags{}
-	flag.StringVar(&args.fromFile, "from", "", "Path to manifests file before upgrade.")
-	flag.StringVar(&args.toFile, "to", "", "Path to manifests file of upgrade.")
-	flag.StringVar(&args.outputFile, "output", "", "Name of the cleanup script file to be generated.")
-	flag.StringVar(&args.ignored, "ignore", "", "List of resources to ignore."+
-		"\nUsage: -ignore kind1:name1,kind2:name2"+
-		"\nExample: -ignore service:foo,servicemonitors.monitoring.coreos.com:bar")
-	flag.Parse()
-
+	args, err := parseFlags(flag.CommandLine, os.Args[1:])
 	out := os.Stdout
+	if args.outputFile == "-" {
+		// keep the script on stdout free of messages
+		out = os.Stderr
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if args.printVersion {
+		fmt.Fprintf(out, "%s\n", versionInfo())
+		return
+	}
 	if err := run(out, args); err != nil {
-		fmt.Fprintf(out, "Error: %v\n", err)
+		if errors.Is(err, errOrphansFound) {
+			os.Exit(3)
+		}
+		// keep errors out of the JSON and YAML documents on stdout
+		fmt.Fprintf(stderr, "Error: %v\n", err)
 		os.Exit(2)
 	}
 }
 
+// versionInfo describes the build, e.g. "migrate 1.2.0 (commit 3f2a9c1, go1.17.13)".
+func versionInfo() string {
+	details := []string{runtime.Version()}
+	if len(commit) > 0 {
+		details = append([]string{"commit " + commit}, details...)
+	}
+	return fmt.Sprintf("migrate %s (%s)", version, strings.Join(details, ", "))
+}
+
+func parseFlags(fs *flag.FlagSet, arguments []string) (flags, error) {
+	var args = flags{}
+	var configFile string
+	fs.StringVar(&configFile, "config", "", "Path to a YAML file providing default values for any of the other flags, keyed by flag name."+
+		"\nFlags passed on the command line take precedence over the config file.")
+	fs.StringVar(&args.fromFile, "from", "", "Path or URL of the manifests before upgrade, or - for stdin. A comma separated list is compared as a single manifest, directories are searched for YAML files recursively.")
+	fs.StringVar(&args.toFile, "to", "", "Path or URL of the manifests of upgrade, or - for stdin. A comma separated list is compared as a single manifest, directories are searched for YAML files recursively.")
+	fs.StringVar(&args.outputDir, "output-dir", "", "Directory to create the cleanup script in as cleanup-001.sh, or several numbered scripts if limited by -max-lines-per-file.")
+	fs.IntVar(&args.maxLinesPerFile, "max-lines-per-file", 0, "Maximum number of lines, apart from the header, of each script created in -output-dir.")
+	fs.StringVar(&args.fromConfigMap, "from-configmap", "", "Reference to a ConfigMap data key holding the manifests before upgrade, instead of -from."+
+		"\nUsage: -from-configmap path/to/configmap.yaml#key")
+	fs.StringVar(&args.toConfigMap, "to-configmap", "", "Reference to a ConfigMap data key holding the manifests of upgrade, instead of -to."+
+		"\nUsage: -to-configmap path/to/configmap.yaml#key")
+	fs.StringVar(&args.keepList, "keep-list", "", "Path to a file listing the resources to keep as kind/name per line, instead of -to. All other resources of -from are deleted.")
+	fs.StringVar(&args.outputFile, "output", "", "Name of the cleanup script file to be generated, - writes the script to stdout and the messages to stderr.")
+	fs.StringVar(&args.ignored, "ignore", "", "List of resources to ignore, an entry without name ignores all resources of the kind."+
+		"\nUsage: -ignore kind1:name1,kind2:name2,kind3"+
+		"\nExample: -ignore service:foo,servicemonitor.monitoring.coreos.com:bar,configmap")
+	fs.StringVar(&args.ignoreFile, "ignore-file", "", "Path to a file listing resources to ignore in addition to -ignore, one kind:name or kind entry per line.")
+	fs.StringVar(&args.ignoreRegex, "ignore-regex", "", "List of kinds with a regular expression, resources of the kind whose name matches it are ignored."+
+		"\nUsage: -ignore-regex kind1:pattern1,kind2:pattern2"+
+		"\nExample: -ignore-regex configmap:^tracing-.*")
+	fs.StringVar(&args.allowed, "allow", "", "List of kind and namespace pairs, only resources matching one of them are deleted. Use * to match any kind or namespace."+
+		"\nUsage: -allow kind1@namespace1,kind2@namespace2"+
+		"\nExample: -allow configmap@kyma-system,servicemonitor.monitoring.coreos.com@*")
+	fs.StringVar(&args.createdBefore, "created-before", "", "Only delete resources created before this RFC3339 time, e.g. the start of the upgrade. Resources without creation timestamp, like those of dry-run manifests, are still deleted.")
+	fs.StringVar(&args.filterCommand, "filter-command", "", "Shell command deciding for each resource whether to delete it. The command receives the resource as JSON on stdin, resources are only deleted if it exits with 0.")
+	fs.StringVar(&args.maxPerKind, "max-per-kind", "", "Fail if more resources of a kind are to be deleted than its limit allows, unlimited by default."+
+		"\nUsage: -max-per-kind kind1=n1,kind2=n2"+
+		"\nExample: -max-per-kind configmap=5,servicemonitor.monitoring.coreos.com=2")
+	fs.BoolVar(&args.force, "force", false, "Ignore the limits of -max-per-kind.")
+	fs.BoolVar(&args.failOnOrphans, "fail-on-orphans", false, "Exit with code 3 if orphaned resources are left after filtering, e.g. to gate a pipeline on the cleanup. Errors exit with code 2, no orphans with code 0.")
+	fs.BoolVar(&args.failOnEmpty, "fail-on-empty", false, "Fail if the filters leave none of the orphaned resources to be deleted, e.g. to catch a misconfigured allowlist.")
+	fs.BoolVar(&args.deleteKept, "delete-kept", false, "Also delete resources annotated with helm.sh/resource-policy: keep, which are skipped by default as Helm preserves them on purpose.")
+	fs.BoolVar(&args.includeOwned, "include-owned", false, "Also delete resources having ownerReferences, which are skipped by default as Kubernetes garbage collects them along with their owners.")
+	fs.BoolVar(&args.withFinalizersOnly, "with-finalizers-only", false, "Only delete resources having finalizers.")
+	fs.BoolVar(&args.withoutFinalizersOnly, "without-finalizers-only", false, "Only delete resources without finalizers.")
+	fs.BoolVar(&args.strict, "strict", true, "Abort the generated script on the first failure with set -euo pipefail, or set -eu if -shebang is no bash, disable for best-effort deletion. Not emitted with -no-shebang.")
+	fs.BoolVar(&args.reportFailures, "report-failures", false, "Print which resource failed to be deleted, aborting the script in -strict mode.")
+	fs.StringVar(&args.shebang, "shebang", defaultShebang, "First line of the generated script, e.g. #!/bin/sh, the #! is prepended if missing.")
+	fs.StringVar(&args.shell, "shell", shellBash, "Shell the deletion script is generated for, one of: bash, powershell.")
+	fs.BoolVar(&args.noShebang, "no-shebang", false, "Omit the shebang line from the generated script, e.g. to embed it in a larger script.")
+	fs.DurationVar(&args.sleep, "sleep", 0, "Pause between the generated deletions, e.g. 500ms or 2s.")
+	fs.BoolVar(&args.emitHeaderEnv, "emit-header-env", false, "Declare a NAMESPACE variable at the top of the script, defaulting to -namespace, and delete the resources of that namespace in $NAMESPACE.")
+	fs.BoolVar(&args.ignoreNotFound, "ignore-not-found", true, "Pass --ignore-not-found to every deletion, so the script can be run again after resources were already deleted.")
+	fs.BoolVar(&args.now, "now", false, "Pass --now to every deletion, signaling the resources to terminate immediately.")
+	fs.StringVar(&args.dryRun, "dry-run", "", "Add --dry-run with the given strategy, client or server, to every deletion, to preview the cleanup against a cluster without deleting anything.")
+	fs.StringVar(&args.gracePeriod, "grace-period", "", "Seconds passed as --grace-period to every deletion, by default the grace period of the resources applies.")
+	fs.StringVar(&args.commandTemplate, "command-template", defaultCommandTemplate, "Go template of the deletion of a resource, receiving its APIVersion, Kind, Name and Namespace,"+
+		" the kubectl Command with the deletion flags and the Target, i.e. resource type and name, e.g. to use oc instead of kubectl.")
+	fs.BoolVar(&args.forceDelete, "force-delete", false, "Pass --force to every deletion, usually along with -grace-period 0.")
+	fs.DurationVar(&args.timeout, "timeout", 0, "Passed as --timeout to every deletion, e.g. 5m, by default kubectl derives it from the grace period.")
+	fs.StringVar(&args.wait, "wait", "", "Passed as --wait to every deletion, true or false, by default kubectl waits for the resources to be gone.")
+	fs.StringVar(&args.namespace, "namespace", defaultNamespace, "Namespace to delete resources in which don't declare a namespace of their own.")
+	fs.StringVar(&args.context, "context", "", "Kubeconfig context passed to every generated deletion.")
+	fs.StringVar(&args.contextMap, "context-map", "", "Kubeconfig contexts per namespace, overriding -context for resources in these namespaces."+
+		"\nUsage: -context-map namespace1=context1,namespace2=context2")
+	fs.StringVar(&args.format, "format", formatText, "Output format of the resources to be deleted, one of: text, json, yaml, argocd, narrative."+
+		"\nThe json and yaml formats print the resources as a sequence of objects with apiVersion, kind, name and namespace, all other messages are written to stderr."+
+		"\nThe argocd format prints the resources as group/version/kind/namespace/name references, e.g. for the resources of an Argo CD sync operation.")
+	fs.StringVar(&args.summaryFormat, "summary-format", formatText, "Format of the summary of resources to be deleted, one of: text, json, table."+
+		"\nIndependent of the generated script and report file.")
+	fs.StringVar(&args.reportFile, "report-file", "", "Name of a JSON report file listing the resources to be deleted, can be combined with -output.")
+	fs.StringVar(&args.applyOutput, "apply-output", "", "Name of a script to be created, which applies the resources added by the upgrade, i.e. present in -to but not in -from.")
+	fs.StringVar(&args.pruneOutput, "prune-output", "", "Name of a file receiving the manifests of -from without the resources to be deleted, keeping the other documents and their comments as they are."+
+		"\nFails if a List or array declares resources to be deleted along with kept ones, since such a document is written whole or not at all.")
+	fs.StringVar(&args.severityFile, "severity-file", "", "Path to a YAML file mapping kinds to the severity of deleting their resources, one of: info, warning, critical."+
+		"\nThe summary marks resources of warning and critical severity, the table summary, the report and -format json and yaml show every severity."+
+		"\nOverrides the defaults, which rate ConfigMaps as info, CustomResourceDefinitions as warning and Namespaces and volumes as critical.")
+	fs.BoolVar(&args.includeAnnotations, "include-annotations", false, "Include the annotations of each resource in the report file, or in the output of -format json and yaml.")
+	fs.BoolVar(&args.workloadsBeforeServices, "workloads-before-services", true, "Delete workloads like Deployments and StatefulSets before the Services backed by them.")
+	fs.BoolVar(&args.preserveOrder, "preserve-order", false, "Delete the resources in the order of their documents in -from instead of sorted by kind and name, -kind-priority and -workloads-before-services are not applied.")
+	fs.BoolVar(&args.deleteStatefulSetPVCs, "delete-statefulset-pvcs", false, "Also delete the PersistentVolumeClaims Kubernetes retains for each replica of a deleted StatefulSet.")
+	fs.BoolVar(&args.kindPriority, "kind-priority", true, "Delete custom resources first and CustomResourceDefinitions and Namespaces last, so resources don't lose the definitions or namespaces they depend on. -order-file takes precedence.")
+	fs.BoolVar(&args.reverse, "reverse", false, "Reverse the deletion order, e.g. to tear down manifests given in install order.")
+	fs.StringVar(&args.orderFile, "order-file", "", "Path to a file listing kinds in deletion order, one per line. Kinds not listed are deleted last.")
+	fs.BoolVar(&args.selectorDelete, "selector-delete", false, "Delete orphans of the same kind and namespace by the labels they have in common, if these labels select no other resource of both manifests.")
+	fs.BoolVar(&args.restoreComments, "restore-comments", false, "Precede each deletion with a comment naming the apiVersion, kind and name needed to restore the resource.")
+	fs.BoolVar(&args.byUID, "by-uid", false, "Only delete resources still having the uid recorded in the manifest, so recreated resources of the same name are kept.")
+	fs.StringVar(&args.requireLabel, "require-label", "", "Only delete resources still carrying this label when the script runs, e.g. to keep resources adopted by a new owner."+
+		"\nUsage: -require-label key=value")
+	fs.BoolVar(&args.optimized, "optimized", false, "Write a compact script with a block per namespace, which sets the namespace once, only runs if the namespace still exists and deletes the resources of a kind with a single kubectl invocation.")
+	fs.BoolVar(&args.functions, "functions", false, "Group the deletions into one bash function per namespace, e.g. cleanup_kyma_system, which are all called at the end of the script.")
+	fs.BoolVar(&args.validateScript, "validate-script", false, "Check the syntax of the generated script with bash -n, if bash is available.")
+	fs.BoolVar(&args.stdinBatch, "stdin-batch", false, "Delete the resources of each namespace with a single kubectl invocation reading them from stdin.")
+	fs.StringVar(&args.onMissingKind, "on-missing-kind", manifest.MissingKindSkip, "How to handle documents having an apiVersion but no kind, one of: skip, error, infer."+
+		"\nThe infer policy takes the kind from the last-applied-configuration annotation and skips the document if it has none.")
+	fs.BoolVar(&args.safeOnParseWarnings, "safe-on-parse-warnings", false, "Fail instead of generating anything when documents of the 'to' manifest had to be skipped while parsing.")
+	fs.StringVar(&args.namespaceLabel, "namespace-label", "", "Label carrying the namespace of a resource, taking precedence over its metadata.namespace.")
+	fs.StringVar(&args.normalizeNameRegex, "normalize-name-regex", "", "Regular expression whose matches are replaced in the names of both manifests before comparing them."+
+		"\nExample: -normalize-name-regex '-(prod|staging)$'")
+	fs.StringVar(&args.normalizeNameReplacement, "normalize-name-replacement", "", "Replacement for the matches of -normalize-name-regex, may reference capture groups like ${1}.")
+	fs.BoolVar(&args.verbose, "verbose", false, "Print how many resources were parsed and left after each filtering step,"+
+		" and log the parsed and orphaned resources and why resources were ignored to stderr.")
+	fs.BoolVar(&args.verbose, "v", false, "Shorthand for -verbose.")
+	fs.BoolVar(&args.printVersion, "version", false, "Print the version of the build and exit.")
+	fs.BoolVar(&args.quiet, "quiet", false, "Suppress all informational output like the summary, only errors are printed.")
+	fs.BoolVar(&args.showUnchanged, "show-unchanged", false, "Also print the resources present in both manifests.")
+	fs.BoolVar(&args.kindsReport, "kinds-report", false, "Print every distinct kind of both manifests with the number of its resources, e.g. to audit scope files.")
+	fs.BoolVar(&args.previewResolved, "preview-resolved", false, "Print the deletion commands as they are resolved for the script, including namespaces, contexts and flags.")
+	fs.BoolVar(&args.exitSummary, "exit-summary", false, "Print a final JSON line to stderr summarizing the run, e.g. for orchestration, independent of the output format.")
+	fs.BoolVar(&args.parseOnly, "parse-only", false, "Only validate that both manifests can be parsed and print their resource counts.")
+	if err := fs.Parse(arguments); err != nil {
+		return args, err
+	}
+	if len(configFile) > 0 {
+		if err := loadConfig(fs, configFile); err != nil {
+			return args, err
+		}
+	}
+	return args, nil
+}
+
+// stderr receives the -exit-summary line, separate from the primary output.
+var stderr io.Writer = os.Stderr
+
+// stdout receives the script with -output -.
+var stdout io.Writer = os.Stdout
+
+// errOrphansFound is returned by run with -fail-on-orphans, main exits with code 3 on it.
+var errOrphansFound = errors.New("orphaned resources found")
+
+// exitSummary is the machine-readable summary of a run printed by -exit-summary.
+type exitSummary struct {
+	From          int    `json:"from"`
+	To            int    `json:"to"`
+	Orphaned      int    `json:"orphaned"`
+	ToDelete      int    `json:"toDelete"`
+	ScriptWritten bool   `json:"scriptWritten"`
+	Output        string `json:"output,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
 func run(out io.Writer, f flags) error {
-	if len(f.fromFile) == 0 {
-		return errors.New("flag not specified: from")
+	_, err := runWithResult(out, f)
+	return err
+}
+
+// runWithResult runs the cleanup like run and returns the orphaned resources left after
+// filtering, nil if the manifests are equal or no comparison took place.
+func runWithResult(out io.Writer, f flags) ([]manifest.Resource, error) {
+	var summary exitSummary
+	if f.quiet {
+		out = io.Discard
+	}
+	orphaned, err := cleanup(out, f, &summary)
+	if f.exitSummary {
+		if err != nil {
+			summary.Error = err.Error()
+		}
+		if err := json.NewEncoder(stderr).Encode(summary); err != nil {
+			return nil, err
+		}
+	}
+	return orphaned, err
+}
+
+func cleanup(out io.Writer, f flags, summary *exitSummary) ([]manifest.Resource, error) {
+	if len(f.fromFile) == 0 && len(f.fromConfigMap) == 0 {
+		return nil, errors.New("flag not specified: from")
+	}
+	if len(f.toFile) == 0 && len(f.toConfigMap) == 0 && len(f.keepList) == 0 {
+		return nil, errors.New("flag not specified: to")
+	}
+	if err := validateFlags(f); err != nil {
+		return nil, err
+	}
+	if len(f.namespace) == 0 {
+		f.namespace = defaultNamespace
+	}
+	switch f.format {
+	case "", formatText, formatJSON, formatYAML, formatArgoCD, formatNarrative:
+	default:
+		return nil, fmt.Errorf("unsupported format: %v", f.format)
+	}
+	switch f.summaryFormat {
+	case "", formatText, formatJSON, formatTable:
+	default:
+		return nil, fmt.Errorf("unsupported summary format: %v", f.summaryFormat)
 	}
-	if len(f.toFile) == 0 {
-		return errors.New("flag not specified: to")
+	if seconds, err := strconv.Atoi(f.gracePeriod); len(f.gracePeriod) > 0 && (err != nil || seconds < 0) {
+		return nil, fmt.Errorf("invalid grace period, expected a non-negative number of seconds: %v", f.gracePeriod)
+	}
+	switch f.shell {
+	case "", shellBash, shellPowerShell:
+	default:
+		return nil, fmt.Errorf("unsupported shell: %v", f.shell)
+	}
+	if _, err := strconv.ParseBool(f.wait); len(f.wait) > 0 && err != nil {
+		return nil, fmt.Errorf("invalid wait, expected true or false: %v", f.wait)
+	}
+	switch f.dryRun {
+	case "", "client", "server":
+	default:
+		return nil, fmt.Errorf("unsupported dry-run strategy, expected client or server: %v", f.dryRun)
+	}
+	switch f.onMissingKind {
+	case "", manifest.MissingKindSkip, manifest.MissingKindError, manifest.MissingKindInfer:
+	default:
+		return nil, fmt.Errorf("unsupported missing kind policy: %v", f.onMissingKind)
 	}
 
-	from, err := parseManifest(out, f.fromFile)
+	document := out
+	if (f.format == formatJSON || f.format == formatYAML) && !f.quiet {
+		// keep the document parseable, the messages are written to stderr instead
+		out = stderr
+	}
+
+	fromSource, toSource := f.fromFile, f.toFile
+	if len(f.fromConfigMap) > 0 {
+		fromSource = f.fromConfigMap
+	}
+	if len(f.toConfigMap) > 0 {
+		toSource = f.toConfigMap
+	}
+	if len(f.keepList) > 0 {
+		toSource = f.keepList
+	}
+	from, _, err := loadManifest(out, f.fromFile, f.fromConfigMap, f.onMissingKind, f.namespace)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var to map[string]manifest.Resource
+	var toSkipped int
+	if len(f.keepList) > 0 {
+		to, err = keptResources(from, f.keepList)
+	} else {
+		to, toSkipped, err = loadManifest(out, f.toFile, f.toConfigMap, f.onMissingKind, f.namespace)
 	}
-	to, err := parseManifest(out, f.toFile)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	summary.From, summary.To = len(from), len(to)
+	if f.parseOnly || f.verbose {
+		fmt.Fprintf(out, "Parsed %d resources from '%s'\n", len(from), fromSource)
+		fmt.Fprintf(out, "Parsed %d resources from '%s'\n", len(to), toSource)
+	}
+	if f.parseOnly {
+		return nil, nil
+	}
+	if len(f.normalizeNameRegex) > 0 {
+		re, err := regexp.Compile(f.normalizeNameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name normalization regex: %v", err)
+		}
+		from = normalizeNames(from, re, f.normalizeNameReplacement, f.namespace)
+		to = normalizeNames(to, re, f.normalizeNameReplacement, f.namespace)
+	}
+	if len(f.namespaceLabel) > 0 {
+		from = namespacesFromLabel(from, f.namespaceLabel, f.namespace)
+		to = namespacesFromLabel(to, f.namespaceLabel, f.namespace)
 	}
-	var ignored []kindName
+	if f.safeOnParseWarnings && toSkipped > 0 {
+		return nil, fmt.Errorf("%d document(s) of '%s' were skipped, refusing to look for orphans as the skipped resources might still be part of the upgrade", toSkipped, toSource)
+	}
+	var ignored []manifest.Ignored
 	if len(f.ignored) > 0 {
 		ignored, err = parseIgnoredManifests(f.ignored)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if len(f.ignoreFile) > 0 {
+		fromFile, err := readIgnoreFile(f.ignoreFile)
+		if err != nil {
+			return nil, err
+		}
+		ignored = append(ignored, fromFile...)
+	}
+	var ignoredPatterns []manifest.IgnoredPattern
+	if len(f.ignoreRegex) > 0 {
+		ignoredPatterns, err = parseIgnoredPatterns(f.ignoreRegex)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var createdBefore time.Time
+	if len(f.createdBefore) > 0 {
+		createdBefore, err = time.Parse(time.RFC3339, f.createdBefore)
+		if err != nil {
+			return nil, fmt.Errorf("invalid creation time cutoff: %v", err)
+		}
+	}
+	var kindLimits map[string]int
+	if len(f.maxPerKind) > 0 {
+		kindLimits, err = parseKindLimits(f.maxPerKind)
+		if err != nil {
+			return nil, err
 		}
 	}
-	orphaned := compare(from, to)
+	var allowed []kindNamespace
+	if len(f.allowed) > 0 {
+		allowed, err = parseAllowlist(f.allowed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if f.kindsReport {
+		if err = printKindsReport(out, from, to); err != nil {
+			return nil, err
+		}
+	}
+	if f.showUnchanged {
+		printUnchanged(out, manifest.Intersect(from, to))
+	}
+	if len(f.applyOutput) > 0 {
+		if err = writeApplyScript(out, f, manifest.Compare(to, from)); err != nil {
+			return nil, err
+		}
+	}
+	logResources(f, "parsed from:", sortedKeys(from))
+	logResources(f, "parsed to:", sortedKeys(to))
+	orphaned := manifest.Compare(from, to)
+	verbosef(out, f, "Found %d orphaned resources\n", len(orphaned))
+	logResources(f, "orphaned:", resourceKeys(orphaned, f.namespace))
+	summary.Orphaned = len(orphaned)
+	if isTextOutput(f) {
+		printVersionChanges(out, manifest.VersionChanged(from, to))
+	}
 	if len(orphaned) == 0 {
 		fmt.Fprintf(out, "Manifests are equal\n")
-		return nil
+		switch f.format {
+		case formatJSON:
+			return nil, printJSONSummary(document, f, nil, nil)
+		case formatYAML:
+			return nil, printYAMLResources(document, f, nil, nil)
+		}
+		return nil, nil
+	}
+	if len(allowed) > 0 {
+		orphaned = filterAllowed(orphaned, allowed, f.namespace)
+		verbosef(out, f, "%d resources left after applying the allowlist\n", len(orphaned))
+	}
+	if f.verbose {
+		for _, m := range orphaned {
+			if by := manifest.IgnoredBy(m, ignored, ignoredPatterns); len(by) > 0 {
+				fmt.Fprintf(stderr, "ignored: %s by %s\n", manifest.ResourceKey(m, f.namespace), by)
+			}
+		}
+	}
+	orphaned = manifest.RemoveIgnored(orphaned, ignored, ignoredPatterns)
+	verbosef(out, f, "%d resources left after removing ignored resources\n", len(orphaned))
+	if kept := removeKept(orphaned); !f.deleteKept && len(kept) < len(orphaned) {
+		orphaned = kept
+		verbosef(out, f, "%d resources left after removing resources kept by their resource policy\n", len(orphaned))
+	}
+	if owned := removeOwned(orphaned); !f.includeOwned && len(owned) < len(orphaned) {
+		orphaned = owned
+		verbosef(out, f, "%d resources left after removing resources having owners\n", len(orphaned))
+	}
+	if !createdBefore.IsZero() {
+		orphaned = removeCreatedAfter(orphaned, createdBefore)
+		verbosef(out, f, "%d resources left after removing resources created after %s\n", len(orphaned), f.createdBefore)
+	}
+	if f.withFinalizersOnly || f.withoutFinalizersOnly {
+		orphaned = filterByFinalizers(orphaned, f.withFinalizersOnly)
+		verbosef(out, f, "%d resources left after filtering by finalizers\n", len(orphaned))
+	}
+	if len(f.filterCommand) > 0 {
+		orphaned, err = filterByCommand(orphaned, f.filterCommand)
+		if err != nil {
+			return nil, err
+		}
+		verbosef(out, f, "%d resources left after applying the filter command\n", len(orphaned))
+	}
+	severities, err := readSeverities(f.severityFile)
+	if err != nil {
+		return nil, err
+	}
+	summary.ToDelete = len(orphaned)
+	if f.failOnEmpty && len(orphaned) == 0 {
+		return nil, fmt.Errorf("all %d orphaned resources were filtered out, nothing left to delete", summary.Orphaned)
 	}
-	orphaned = removeIgnored(orphaned, ignored)
 
-	printSummary(out, orphaned)
-	if len(f.outputFile) > 0 {
-		if err = generateDeletionScript(out, f.outputFile, orphaned); err != nil {
-			return err
+	switch {
+	case f.format == formatArgoCD:
+		err = printArgoCDResources(out, orphaned, f.namespace)
+	case f.format == formatNarrative:
+		printNarrative(out, orphaned, f.namespace)
+	case f.format == formatYAML:
+		err = printYAMLResources(document, f, orphaned, severities)
+	case f.format == formatJSON, f.summaryFormat == formatJSON:
+		err = printJSONSummary(document, f, orphaned, severities)
+	case f.summaryFormat == formatTable:
+		err = printTableSummary(out, orphaned, f.namespace, severities)
+	default:
+		var deprecated map[string]bool
+		if len(f.keepList) == 0 {
+			deprecated = deprecatedKinds(from, to)
+		}
+		printSummary(out, orphaned, deprecated, severities)
+		for _, namespace := range emptiedNamespaces(orphaned, from, to, f.namespace) {
+			fmt.Fprintf(out, "Namespace %s has no resources left after the deletions, consider deleting it as well\n", namespace)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !f.force {
+		if err = checkKindLimits(orphaned, kindLimits); err != nil {
+			return nil, err
+		}
+	}
+	var selectors map[string]string
+	if f.selectorDelete {
+		selectors = commonLabelSelectors(orphaned, from, to, f.namespace)
+	}
+	if f.previewResolved {
+		if err = printResolvedCommands(out, f, orphaned, selectors); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.outputFile) > 0 || len(f.outputDir) > 0 {
+		if len(orphaned) == 0 {
+			fmt.Fprintf(out, "No resources left to delete, the deletion script was not created\n")
+		} else if err = generateDeletionScript(out, f, orphaned, selectors); err != nil {
+			return nil, err
+		} else {
+			summary.ScriptWritten = true
+			summary.Output = f.outputFile
+			if len(f.outputDir) > 0 {
+				summary.Output = f.outputDir
+			}
+		}
+	}
+	if len(f.reportFile) > 0 {
+		if err = writeReport(out, f, orphaned, severities); err != nil {
+			return nil, err
+		}
+	}
+	if len(f.pruneOutput) > 0 {
+		if err = writePrunedManifest(out, f, orphaned); err != nil {
+			return nil, err
+		}
+	}
+	if f.failOnOrphans && len(orphaned) > 0 {
+		return orphaned, errOrphansFound
+	}
+	return orphaned, nil
+}
+
+// flagConstraints lists the flag combinations which are rejected up front.
+var flagConstraints = []struct {
+	violated func(f flags) bool
+	message  string
+}{
+	{
+		violated: func(f flags) bool { return f.parseOnly && len(f.outputFile) > 0 },
+		message:  "-parse-only cannot be combined with -output",
+	},
+	{
+		violated: func(f flags) bool { return f.parseOnly && len(f.reportFile) > 0 },
+		message:  "-parse-only cannot be combined with -report-file",
+	},
+	{
+		violated: func(f flags) bool { return len(f.fromFile) > 0 && len(f.fromConfigMap) > 0 },
+		message:  "-from cannot be combined with -from-configmap",
+	},
+	{
+		violated: func(f flags) bool { return len(f.toFile) > 0 && len(f.toConfigMap) > 0 },
+		message:  "-to cannot be combined with -to-configmap",
+	},
+	{
+		violated: func(f flags) bool { return f.stdinBatch && f.selectorDelete },
+		message:  "-stdin-batch cannot be combined with -selector-delete",
+	},
+	{
+		violated: func(f flags) bool { return readsStdin(f.fromFile) && readsStdin(f.toFile) },
+		message:  "-from and -to cannot both read stdin",
+	},
+	{
+		violated: func(f flags) bool { return len(f.keepList) > 0 && (len(f.toFile) > 0 || len(f.toConfigMap) > 0) },
+		message:  "-keep-list cannot be combined with -to or -to-configmap",
+	},
+	{
+		violated: func(f flags) bool { return len(f.outputFile) > 0 && len(f.outputDir) > 0 },
+		message:  "-output cannot be combined with -output-dir",
+	},
+	{
+		violated: func(f flags) bool { return f.parseOnly && len(f.outputDir) > 0 },
+		message:  "-parse-only cannot be combined with -output-dir",
+	},
+	{
+		violated: func(f flags) bool { return f.maxLinesPerFile > 0 && len(f.outputDir) == 0 },
+		message:  "-max-lines-per-file requires -output-dir",
+	},
+	{
+		violated: func(f flags) bool { return len(f.applyOutput) > 0 && (len(f.toFile) == 0 || readsStdin(f.toFile)) },
+		message:  "-apply-output requires -to naming files or URLs",
+	},
+	{
+		violated: func(f flags) bool { return f.parseOnly && len(f.applyOutput) > 0 },
+		message:  "-parse-only cannot be combined with -apply-output",
+	},
+	{
+		violated: func(f flags) bool { return len(f.pruneOutput) > 0 && len(f.fromFile) == 0 },
+		message:  "-prune-output requires -from",
+	},
+	{
+		violated: func(f flags) bool { return len(f.pruneOutput) > 0 && readsStdin(f.fromFile) },
+		message:  "-prune-output cannot be combined with -from reading stdin",
+	},
+	{
+		violated: func(f flags) bool { return f.parseOnly && len(f.pruneOutput) > 0 },
+		message:  "-parse-only cannot be combined with -prune-output",
+	},
+	{
+		violated: func(f flags) bool { return f.now && len(f.gracePeriod) > 0 },
+		message:  "-now cannot be combined with -grace-period, it is equivalent to -grace-period=1",
+	},
+	{
+		violated: func(f flags) bool { return f.validateScript && f.outputFile == "-" },
+		message:  "-validate-script cannot be combined with -output -",
+	},
+	{
+		violated: func(f flags) bool { return f.validateScript && len(f.outputFile) == 0 && len(f.outputDir) == 0 },
+		message:  "-validate-script requires -output or -output-dir",
+	},
+	{
+		violated: func(f flags) bool { return f.optimized && (f.stdinBatch || f.selectorDelete) },
+		message:  "-optimized cannot be combined with -stdin-batch or -selector-delete",
+	},
+	{
+		violated: func(f flags) bool { return f.optimized && (f.byUID || len(f.requireLabel) > 0) },
+		message:  "-optimized cannot be combined with -by-uid or -require-label",
+	},
+	{
+		violated: func(f flags) bool {
+			return len(f.commandTemplate) > 0 && f.commandTemplate != defaultCommandTemplate && (f.stdinBatch || f.optimized)
+		},
+		message: "-command-template cannot be combined with -stdin-batch or -optimized",
+	},
+	{
+		violated: func(f flags) bool { return f.noShebang && len(f.shebang) > 0 && f.shebang != defaultShebang },
+		message:  "-no-shebang cannot be combined with -shebang",
+	},
+	{
+		violated: func(f flags) bool {
+			return f.shell == shellPowerShell && len(f.shebang) > 0 && f.shebang != defaultShebang
+		},
+		message: "-shell powershell cannot be combined with -shebang, PowerShell scripts have no shebang",
+	},
+	{
+		violated: func(f flags) bool {
+			return f.shell == shellPowerShell && (f.byUID || len(f.requireLabel) > 0 || f.reportFailures || f.functions || f.stdinBatch ||
+				f.optimized || f.emitHeaderEnv || f.validateScript || len(f.applyOutput) > 0)
+		},
+		message: "-shell powershell cannot be combined with -by-uid, -require-label, -report-failures, -functions, -stdin-batch, -optimized, -emit-header-env, -validate-script or -apply-output, they generate bash",
+	},
+	{
+		violated: func(f flags) bool { return f.quiet && (f.verbose || !isTextOutput(f)) },
+		message:  "-quiet cannot be combined with -verbose, -format or -summary-format",
+	},
+	{
+		violated: func(f flags) bool { return f.reportFailures && (f.stdinBatch || f.optimized) },
+		message:  "-report-failures cannot be combined with -stdin-batch or -optimized",
+	},
+	{
+		violated: func(f flags) bool { return f.byUID && f.stdinBatch },
+		message:  "-by-uid cannot be combined with -stdin-batch",
+	},
+	{
+		violated: func(f flags) bool { return f.byUID && f.selectorDelete },
+		message:  "-by-uid cannot be combined with -selector-delete",
+	},
+	{
+		violated: func(f flags) bool { return len(f.requireLabel) > 0 && f.stdinBatch },
+		message:  "-require-label cannot be combined with -stdin-batch",
+	},
+	{
+		violated: func(f flags) bool { return len(f.requireLabel) > 0 && f.selectorDelete },
+		message:  "-require-label cannot be combined with -selector-delete",
+	},
+	{
+		violated: func(f flags) bool { return f.withFinalizersOnly && f.withoutFinalizersOnly },
+		message:  "-with-finalizers-only cannot be combined with -without-finalizers-only",
+	},
+	{
+		violated: func(f flags) bool {
+			return f.includeAnnotations && len(f.reportFile) == 0 && f.format != formatJSON && f.format != formatYAML
+		},
+		message: "-include-annotations requires -report-file or -format json|yaml",
+	},
+	{
+		violated: func(f flags) bool { return len(f.normalizeNameReplacement) > 0 && len(f.normalizeNameRegex) == 0 },
+		message:  "-normalize-name-replacement requires -normalize-name-regex",
+	},
+}
+
+// validateFlags reports all violated flag constraints at once.
+func validateFlags(f flags) error {
+	var violations []string
+	for _, c := range flagConstraints {
+		if c.violated(f) {
+			violations = append(violations, c.message)
 		}
 	}
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid flag combination:\n  %s", strings.Join(violations, "\n  "))
+	}
 	return nil
 }
 
-func parseIgnoredManifests(ignored string) ([]kindName, error) {
-	manifestStrings := strings.Split(ignored, ",")
-	var ignoreManifests []kindName
-	for _, manifestString := range manifestStrings {
-		manifest := strings.Split(manifestString, ":")
-		if len(manifest) != 2 {
-			return nil, fmt.Errorf("invalid ignored manifest format: %v", manifestString)
-		}
-		ignoreManifests = append(ignoreManifests, kindName{
-			kind: manifest[0],
-			name: manifest[1],
-		})
+// verbosef prints details on how the resources to be deleted were determined, if requested.
+func verbosef(out io.Writer, f flags, format string, a ...interface{}) {
+	if f.verbose {
+		fmt.Fprintf(out, format, a...)
 	}
-	return ignoreManifests, nil
 }
 
-func compare(left, right map[string]kindNameVersion) []kindNameVersion {
-	var orphaned []kindNameVersion
-	for k, v := range left {
-		if _, found := right[k]; !found {
-			orphaned = append(orphaned, v)
-		}
+// logResources logs the keys of the resources to stderr in verbose mode, one per line
+// prefixed by what happened to them.
+func logResources(f flags, prefix string, keys []string) {
+	if !f.verbose {
+		return
 	}
+	for _, key := range keys {
+		fmt.Fprintf(stderr, "%s %s\n", prefix, key)
+	}
+}
 
-	sort.Slice(orphaned, func(i, j int) bool {
-		var l, r = orphaned[i], orphaned[j]
-		if l.kind == r.kind {
-			return l.name < r.name
-		}
-		return l.kind < r.kind
-	})
+func sortedKeys(resources map[string]manifest.Resource) []string {
+	keys := make([]string, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
 
-	return orphaned
+func resourceKeys(resources []manifest.Resource, namespace string) []string {
+	keys := make([]string, 0, len(resources))
+	for _, m := range resources {
+		keys = append(keys, manifest.ResourceKey(m, namespace))
+	}
+	return keys
 }
 
-func removeIgnored(knvs []kindNameVersion, ignored []kindName) []kindNameVersion {
-	var filtered []kindNameVersion
-	for _, knv := range knvs {
-		if len(ignored) > 0 && shouldIgnore(knv, ignored) {
+// keptResources returns the resources of from listed in the keep list file, given as
+// kind/name per line. Empty lines and lines starting with '#' are skipped.
+func keptResources(from map[string]manifest.Resource, filePath string) (map[string]manifest.Resource, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read keep list at '%v': %v", filePath, err)
+	}
+	keep := make(map[string]bool)
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
-		filtered = append(filtered, knv)
+		i := strings.Index(line, "/")
+		if i <= 0 || i == len(line)-1 {
+			return nil, fmt.Errorf("invalid keep list entry format: %v", line)
+		}
+		keep[strings.ToLower(line[:i])+"/"+line[i+1:]] = true
 	}
-	return filtered
-}
 
-func shouldIgnore(found kindNameVersion, ignored []kindName) bool {
-	for _, i := range ignored {
-		if i.kind == simpleKind(found) && i.name == found.name {
-			return true
+	kept := make(map[string]manifest.Resource)
+	for k, m := range from {
+		// kinds may be given singular or plural, with or without group
+		for _, kind := range []string{strings.ToLower(m.Kind), manifest.SimpleKind(m), pluralKind(m.Kind), resourceType(m)} {
+			if keep[kind+"/"+m.Name] {
+				kept[k] = m
+				break
+			}
 		}
 	}
-	return false
+	return kept, nil
 }
 
-func parseManifest(out io.Writer, filePath string) (map[string]kindNameVersion, error) {
-	installManifestsYAML, err := os.ReadFile(filePath)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read manifest file at '%v': %v", filePath, err)
-	}
-	manifestsSlice, err := unmarshal(out, string(installManifestsYAML))
-	if err != nil {
-		return nil, fmt.Errorf("unable to parse manifests: %v", err)
+// normalizeNames re-keys the resources by their names with all matches of re replaced,
+// the resources themselves keep their original names.
+func normalizeNames(manifests map[string]manifest.Resource, re *regexp.Regexp, replacement, namespace string) map[string]manifest.Resource {
+	results := make(map[string]manifest.Resource, len(manifests))
+	for _, m := range manifests {
+		results[manifest.Key(manifest.Group(m.APIVersion), m.Kind, namespaceOf(m, namespace), re.ReplaceAllString(m.Name, replacement))] = m
 	}
-	results := make(map[string]kindNameVersion)
-	for _, m := range manifestsSlice {
-		kind := getKind(m)
-		name := getName(m)
-		apiVersion := getAPIVersion(m)
-		results[getKind(m)+getName(m)] = kindNameVersion{
-			apiVersion: apiVersion,
-			kind:       kind,
-			name:       name,
+	return results
+}
+
+// namespacesFromLabel sets the namespace of the resources having the given label to its
+// value, the other resources keep their metadata.namespace.
+func namespacesFromLabel(manifests map[string]manifest.Resource, key, defaultNamespace string) map[string]manifest.Resource {
+	results := make(map[string]manifest.Resource, len(manifests))
+	for _, m := range manifests {
+		if namespace, found := m.Labels[key]; found && len(namespace) > 0 {
+			m.Namespace = namespace
 		}
+		results[manifest.ResourceKey(m, defaultNamespace)] = m
 	}
-	return results, nil
+	return results
 }
 
-func unmarshal(out io.Writer, manifests string) ([]map[string]interface{}, error) {
-	var results []map[string]interface{}
-	decoder := yaml.NewDecoder(strings.NewReader(manifests))
-	for {
-		manifestYaml := make(map[string]interface{})
-		err := decoder.Decode(&manifestYaml)
-		if manifestYaml == nil {
+// parseIgnoredManifests parses the kind:name and kind entries of -ignore. Malformed
+// entries are collected into a single error listing each of them with its
+// index, while the valid entries are still returned.
+func parseIgnoredManifests(ignored string) ([]manifest.Ignored, error) {
+	manifestStrings := strings.Split(ignored, ",")
+	var ignoreManifests []manifest.Ignored
+	var malformed []string
+	for i, manifestString := range manifestStrings {
+		parts := strings.Split(manifestString, ":")
+		if len(parts) > 2 || len(parts[0]) == 0 {
+			malformed = append(malformed, fmt.Sprintf("%d: %v", i, manifestString))
 			continue
 		}
-		if errors.Is(err, io.EOF) {
-			break
+		// an entry without name ignores all resources of the kind
+		entry := manifest.Ignored{Kind: parts[0]}
+		if len(parts) == 2 {
+			entry.Name = parts[1]
 		}
-		var typeError *yaml.TypeError
-		if errors.As(err, &typeError) {
-			fmt.Fprintf(out, "WARN - type error: %v\n", err)
+		ignoreManifests = append(ignoreManifests, entry)
+	}
+	if len(malformed) > 0 {
+		return ignoreManifests, fmt.Errorf("invalid ignored manifest format:\n  %s", strings.Join(malformed, "\n  "))
+	}
+	return ignoreManifests, nil
+}
+
+// readIgnoreFile parses the -ignore entries listed in a file, one per line. Empty lines and
+// lines starting with '#' are skipped.
+func readIgnoreFile(filePath string) ([]manifest.Ignored, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read ignore file at '%v': %v", filePath, err)
+	}
+	var ignored []manifest.Ignored
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
 			continue
 		}
+		entries, err := parseIgnoredManifests(line)
 		if err != nil {
-			return nil, fmt.Errorf("unable to decode manifest to yaml: %v", err)
+			return nil, fmt.Errorf("line %d of ignore file '%v': %v", i+1, filePath, err)
 		}
-		results = append(results, manifestYaml)
+		ignored = append(ignored, entries...)
 	}
-	return results, nil
+	return ignored, nil
 }
 
-func getAPIVersion(manifest map[string]interface{}) string {
-	return manifest["apiVersion"].(string)
+// parseIgnoredPatterns parses the kind:pattern entries of -ignore-regex, compiling the
+// patterns matched against the names of the resources.
+func parseIgnoredPatterns(ignored string) ([]manifest.IgnoredPattern, error) {
+	var patterns []manifest.IgnoredPattern
+	for _, entry := range strings.Split(ignored, ",") {
+		pair := strings.SplitN(entry, ":", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			return nil, fmt.Errorf("invalid ignored pattern format: %v", entry)
+		}
+		name, err := regexp.Compile(pair[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid ignored pattern '%v': %v", entry, err)
+		}
+		patterns = append(patterns, manifest.IgnoredPattern{Kind: pair[0], Name: name})
+	}
+	return patterns, nil
 }
 
-func getKind(manifest map[string]interface{}) string {
-	return manifest["kind"].(string)
+func parseAllowlist(allowed string) ([]kindNamespace, error) {
+	var allowlist []kindNamespace
+	for _, entry := range strings.Split(allowed, ",") {
+		pair := strings.Split(entry, "@")
+		if len(pair) != 2 || len(pair[0]) == 0 || len(pair[1]) == 0 {
+			return nil, fmt.Errorf("invalid allowlist entry format: %v", entry)
+		}
+		allowlist = append(allowlist, kindNamespace{
+			kind:      strings.ToLower(pair[0]),
+			namespace: pair[1],
+		})
+	}
+	return allowlist, nil
 }
 
-func getName(manifest map[string]interface{}) string {
-	return manifest["metadata"].(map[string]interface{})["name"].(string)
+// filterAllowed keeps the resources matching any entry of the allowlist.
+func filterAllowed(knvs []manifest.Resource, allowlist []kindNamespace, namespace string) []manifest.Resource {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		for _, a := range allowlist {
+			kindMatches := a.kind == "*" || a.kind == manifest.SimpleKind(knv) || a.kind == strings.ToLower(knv.Kind)
+			namespaceMatches := a.namespace == "*" || a.namespace == namespaceOf(knv, namespace)
+			if kindMatches && namespaceMatches {
+				filtered = append(filtered, knv)
+				break
+			}
+		}
+	}
+	return filtered
 }
 
-func generateDeletionScript(out io.Writer, withName string, from []kindNameVersion) error {
-	file, err := os.Create(withName)
-	if err != nil {
-		return fmt.Errorf("unable to crea te file: %v", err)
+// removeCreatedAfter drops the resources created after the cutoff, resources without a
+// creation timestamp are not dropped.
+func removeCreatedAfter(knvs []manifest.Resource, cutoff time.Time) []manifest.Resource {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		if knv.Created.After(cutoff) {
+			continue
+		}
+		filtered = append(filtered, knv)
 	}
-	defer func(f *os.File) {
-		_ = f.Close()
-	}(file)
-	w := bufio.NewWriter(file)
-	_, err = w.WriteString("#!/usr/bin/env bash\n\n")
-	if err != nil {
-		return fmt.Errorf("error writing to file: %v", err)
+	return filtered
+}
+
+func parseKindLimits(maxPerKind string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, entry := range strings.Split(maxPerKind, ",") {
+		pair := strings.Split(entry, "=")
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			return nil, fmt.Errorf("invalid kind limit format: %v", entry)
+		}
+		limit, err := strconv.Atoi(pair[1])
+		if err != nil || limit < 0 {
+			return nil, fmt.Errorf("invalid kind limit format: %v", entry)
+		}
+		limits[strings.ToLower(pair[0])] = limit
 	}
+	return limits, nil
+}
 
-	pluralizer := pluralize.NewClient()
-	for _, m := range from {
-		m.kind = pluralizer.Plural(m.kind)
-		kind := simpleKind(m)
-		name := strings.ToLower(m.name)
-		deletionCmd := fmt.Sprintf("kubectl delete -n kyma-system %s %s\n", kind, name)
-		_, err = w.WriteString(deletionCmd)
-		if err != nil {
-			return fmt.Errorf("error writing to file: %v", err)
+// checkKindLimits fails if more resources of a kind are to be deleted than its limit allows,
+// limits are given by simple kind or qualified with the group.
+func checkKindLimits(knvs []manifest.Resource, limits map[string]int) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	var kinds []string
+	counts := make(map[string]int)
+	for _, knv := range knvs {
+		for _, kind := range []string{manifest.SimpleKind(knv), strings.ToLower(knv.Kind)} {
+			if _, found := limits[kind]; found {
+				if counts[kind] == 0 {
+					kinds = append(kinds, kind)
+				}
+				counts[kind]++
+				break
+			}
 		}
 	}
-	err = w.Flush()
-	if err != nil {
-		return fmt.Errorf("error writing to file - %v", err)
+	var exceeded []string
+	for _, kind := range kinds {
+		if counts[kind] > limits[kind] {
+			exceeded = append(exceeded, fmt.Sprintf("%s: %d (limit %d)", kind, counts[kind], limits[kind]))
+		}
 	}
-	_, err = fmt.Fprintf(out, "Deletion script created: '%s'\n", withName)
-	if err != nil {
-		return err
+	if len(exceeded) > 0 {
+		return fmt.Errorf("too many resources to be deleted, use -force to delete them anyway: %s", strings.Join(exceeded, ", "))
 	}
 	return nil
 }
 
-func printSummary(out io.Writer, manifests []kindNameVersion) {
-	if len(manifests) == 0 {
-		return
+// removeKept removes the resources annotated with helm.sh/resource-policy: keep, which Helm
+// leaves in place when they are no longer part of a release.
+func removeKept(knvs []manifest.Resource) []manifest.Resource {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		if knv.Annotations["helm.sh/resource-policy"] != "keep" {
+			filtered = append(filtered, knv)
+		}
+	}
+	return filtered
+}
+
+// removeOwned removes the resources having owners, their deletion is left to the garbage
+// collection, which a manual deletion might race with.
+func removeOwned(knvs []manifest.Resource) []manifest.Resource {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		if len(knv.Owners) == 0 {
+			filtered = append(filtered, knv)
+		}
 	}
-	fmt.Fprintf(out, "Resources to be deleted after upgrade:\n")
+	return filtered
+}
 
-	for _, m := range manifests {
-		fmt.Fprintf(out, "%+v\n", m)
+// filterByFinalizers keeps the resources with finalizers, or those without if withFinalizers is false.
+func filterByFinalizers(knvs []manifest.Resource, withFinalizers bool) []manifest.Resource {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		if (len(knv.Finalizers) > 0) == withFinalizers {
+			filtered = append(filtered, knv)
+		}
+	}
+	return filtered
+}
+
+// filterByCommand keeps the resources for which the shell command exits with 0, the command
+// receives the resource as JSON on stdin.
+func filterByCommand(knvs []manifest.Resource, command string) ([]manifest.Resource, error) {
+	var filtered []manifest.Resource
+	for _, knv := range knvs {
+		resource, err := json.Marshal(toReport([]manifest.Resource{knv}, true, nil)[0])
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal resource: %v", err)
+		}
+		cmd := exec.Command("sh", "-c", command)
+		cmd.Stdin = bytes.NewReader(resource)
+		err = cmd.Run()
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to run filter command: %v", err)
+		}
+		filtered = append(filtered, knv)
 	}
+	return filtered, nil
 }
 
-func simpleKind(m kindNameVersion) string {
-	kind := strings.ToLower(m.kind)
-	if strings.Contains(m.apiVersion, "/") {
-		kind = fmt.Sprintf("%s.%s", kind, strings.ToLower(strings.Split(m.apiVersion, "/")[0]))
+// parseManifest returns the merged resources of the comma separated manifest sources keyed
+// by kind, effective namespace and name, see manifest.ResourceKey, along with the number of
+// documents which had to be skipped. The items of List documents are resources of their own.
+// Resources declared by several sources are taken from the last one.
+func parseManifest(out io.Writer, sources, onMissingKind, namespace string) (map[string]manifest.Resource, int, error) {
+	locations, err := sourceLocations(sources)
+	if err != nil {
+		return nil, 0, err
+	}
+	contents, err := readSources(locations)
+	if err != nil {
+		return nil, 0, err
+	}
+	results := make(map[string]manifest.Resource)
+	origins := make(map[string]string)
+	var skipped, offset int
+	for i, content := range contents {
+		resources, s, err := manifest.Parse(out, content, onMissingKind, namespace)
+		if err != nil {
+			return nil, 0, err
+		}
+		skipped += s
+		next := offset
+		for _, key := range keysByIndex(resources) {
+			m := resources[key]
+			if origin, found := origins[key]; found {
+				fmt.Fprintf(out, "WARN - %s %s of '%s' is also declared in '%s'\n", m.Kind, m.Name, locations[i], origin)
+			}
+			m.Index += offset
+			if m.Index >= next {
+				next = m.Index + 1
+			}
+			results[key], origins[key] = m, locations[i]
+		}
+		offset = next
+	}
+	return results, skipped, nil
+}
+
+// keysByIndex returns the keys of the resources in the order of their documents.
+func keysByIndex(resources map[string]manifest.Resource) []string {
+	keys := make([]string, 0, len(resources))
+	for key := range resources {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return resources[keys[i]].Index < resources[keys[j]].Index
+	})
+	return keys
+}
+
+// loadManifest parses the manifests of the given file, or of the ConfigMap data key
+// referenced by configMap if set.
+func loadManifest(out io.Writer, filePath, configMap, onMissingKind, namespace string) (map[string]manifest.Resource, int, error) {
+	if len(configMap) > 0 {
+		content, err := readConfigMapData(configMap)
+		if err != nil {
+			return nil, 0, err
+		}
+		return manifest.Parse(out, content, onMissingKind, namespace)
+	}
+	return parseManifest(out, filePath, onMissingKind, namespace)
+}
+
+// readConfigMapData returns the value of a data key of the first ConfigMap providing it
+// in a manifest file, referenced as file#key.
+func readConfigMapData(reference string) (string, error) {
+	i := strings.LastIndex(reference, "#")
+	if i <= 0 || i == len(reference)-1 {
+		return "", fmt.Errorf("invalid ConfigMap reference format: %v", reference)
+	}
+	filePath, key := reference[:i], reference[i+1:]
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("unable to read manifest file at '%v': %v", filePath, err)
+	}
+	decoder := yaml.NewDecoder(strings.NewReader(string(content)))
+	for {
+		var configMap struct {
+			Kind string                 `yaml:"kind"`
+			Data map[string]interface{} `yaml:"data"`
+		}
+		err := decoder.Decode(&configMap)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to decode manifest to yaml: %v", err)
+		}
+		if data, found := configMap.Data[key].(string); strings.EqualFold(configMap.Kind, "ConfigMap") && found {
+			return data, nil
+		}
+	}
+	return "", fmt.Errorf("no ConfigMap with data key '%v' found in '%v'", key, filePath)
+}
+
+var pluralizer = pluralize.NewClient()
+
+func generateDeletionScript(out io.Writer, f flags, from []manifest.Resource, selectors map[string]string) error {
+	header, blocks, err := deletionScript(f, from, selectors)
+	if err != nil {
+		return err
+	}
+	if f.outputFile == "-" {
+		return writeLines(stdout, scriptLines(f, header, blocks))
+	}
+	if len(f.outputDir) == 0 {
+		if err := writeScript(out, f.outputFile, scriptLines(f, header, blocks)); err != nil {
+			return err
+		}
+		if f.validateScript {
+			return validateScript(out, f.outputFile)
+		}
+		return nil
+	}
+	if err := os.MkdirAll(f.outputDir, 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %v", err)
+	}
+	for i, chunk := range splitBlocks(f, blocks) {
+		extension := "sh"
+		if f.shell == shellPowerShell {
+			extension = "ps1"
+		}
+		withName := filepath.Join(f.outputDir, fmt.Sprintf("cleanup-%03d.%s", i+1, extension))
+		if err := writeScript(out, withName, scriptLines(f, header, chunk)); err != nil {
+			return err
+		}
+		if f.validateScript {
+			if err := validateScript(out, withName); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateScript checks the syntax of a generated script with bash -n. The check is
+// skipped with a warning if bash is not available.
+func validateScript(out io.Writer, withName string) error {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		fmt.Fprintf(out, "WARN - bash not found, skipping the validation of '%s'\n", withName)
+		return nil
+	}
+	output, err := exec.Command(bash, "-n", withName).CombinedOutput()
+	var exitError *exec.ExitError
+	if errors.As(err, &exitError) {
+		return fmt.Errorf("generated script '%s' has syntax errors: %s", withName, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to validate script: %v", err)
+	}
+	return nil
+}
+
+// printResolvedCommands prints the deletions exactly as they are written to the script.
+func printResolvedCommands(out io.Writer, f flags, from []manifest.Resource, selectors map[string]string) error {
+	_, blocks, err := deletionScript(f, from, selectors)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Resolved deletion commands:\n")
+	for _, line := range scriptLines(f, nil, blocks) {
+		fmt.Fprintf(out, "%s\n", line)
+	}
+	return nil
+}
+
+func writeScript(out io.Writer, withName string, lines []string) error {
+	if info, err := os.Stat(withName); err == nil && info.IsDir() {
+		return fmt.Errorf("output path '%s' is a directory, specify the file name of the script to be created", withName)
+	}
+	file, err := os.Create(withName)
+	if err != nil {
+		return fmt.Errorf("unable to create file: %v", err)
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(file)
+	// make the script directly runnable, also when it replaces an existing file
+	if err = file.Chmod(0755); err != nil {
+		return fmt.Errorf("unable to make file executable: %v", err)
+	}
+	if err = writeLines(file, lines); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "Deletion script created: '%s'\n", withName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func writeLines(to io.Writer, lines []string) error {
+	w := bufio.NewWriter(to)
+	for _, line := range lines {
+		_, err := w.WriteString(line + "\n")
+		if err != nil {
+			return fmt.Errorf("error writing to file: %v", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing to file - %v", err)
+	}
+	return nil
+}
+
+// scriptLines joins the header and the blocks of deletions to the lines of a script.
+func scriptLines(f flags, header []string, blocks [][]string) []string {
+	lines := append([]string(nil), header...)
+	for i, block := range blocks {
+		if i > 0 && f.sleep > 0 {
+			lines = append(lines, sleepCommand(f))
+		}
+		lines = append(lines, block...)
+	}
+	return lines
+}
+
+// sleepCommand pauses the script for -sleep. Start-Sleep -Seconds of PowerShell 5.1 takes
+// whole seconds only, so the pause is given in milliseconds there.
+func sleepCommand(f flags) string {
+	if f.shell == shellPowerShell {
+		return fmt.Sprintf("Start-Sleep -Milliseconds %d", f.sleep.Milliseconds())
+	}
+	return fmt.Sprintf("sleep %s", strconv.FormatFloat(f.sleep.Seconds(), 'f', -1, 64))
+}
+
+// splitBlocks distributes the blocks of deletions to scripts of at most -max-lines-per-file
+// lines each, not counting the header. Blocks are never split, so a block exceeding the
+// limit on its own gets a script of its own.
+func splitBlocks(f flags, blocks [][]string) [][][]string {
+	if f.maxLinesPerFile <= 0 {
+		return [][][]string{blocks}
+	}
+	var chunks [][][]string
+	var chunk [][]string
+	var lines int
+	for _, block := range blocks {
+		needed := len(block)
+		if len(chunk) > 0 && f.sleep > 0 {
+			needed++
+		}
+		if len(chunk) > 0 && lines+needed > f.maxLinesPerFile {
+			chunks = append(chunks, chunk)
+			chunk, lines, needed = nil, 0, len(block)
+		}
+		chunk = append(chunk, block)
+		lines += needed
+	}
+	return append(chunks, chunk)
+}
+
+// deletionScript returns the header of the script deleting the given resources, and the
+// blocks of lines deleting them. Resources of a kind and namespace with a label selector
+// are deleted by that selector instead.
+func deletionScript(f flags, from []manifest.Resource, selectors map[string]string) ([]string, [][]string, error) {
+	contexts, err := parseContextMap(f.contextMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	if f.preserveOrder {
+		from = append([]manifest.Resource(nil), from...)
+		sort.SliceStable(from, func(i, j int) bool {
+			return from[i].Index < from[j].Index
+		})
+	}
+	var labelKey, labelValue string
+	if len(f.requireLabel) > 0 {
+		pair := strings.SplitN(f.requireLabel, "=", 2)
+		if len(pair) != 2 || len(pair[0]) == 0 {
+			return nil, nil, fmt.Errorf("invalid required label format: %v", f.requireLabel)
+		}
+		labelKey, labelValue = pair[0], pair[1]
+	}
+	if f.workloadsBeforeServices && !f.preserveOrder {
+		from = deleteWorkloadsBeforeServices(from)
+	}
+	if f.kindPriority && !f.preserveOrder && len(f.orderFile) == 0 {
+		from = sortByKindPriority(from)
+	}
+	if len(f.orderFile) > 0 {
+		order, err := readDeletionOrder(f.orderFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		from = sortByDeletionOrder(from, order)
+	}
+	if f.reverse {
+		reversed := make([]manifest.Resource, 0, len(from))
+		for i := len(from) - 1; i >= 0; i-- {
+			reversed = append(reversed, from[i])
+		}
+		from = reversed
+	}
+	if f.deleteStatefulSetPVCs {
+		from = withStatefulSetClaims(from)
+	}
+	commandTemplate := f.commandTemplate
+	if len(commandTemplate) == 0 {
+		commandTemplate = defaultCommandTemplate
+	}
+	command, err := template.New("command").Option("missingkey=error").Parse(commandTemplate)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid command template: %v", err)
+	}
+
+	// namespaces holds the namespace of each block, for grouping them into functions
+	var blocks [][]string
+	var namespaces []string
+	if f.stdinBatch {
+		blocks, namespaces = batchDeletions(f, contexts, from)
+	} else if f.optimized {
+		blocks, namespaces = optimizedDeletions(f, contexts, from)
+	} else {
+		selectorBlocks := make(map[string]int)
+		for _, m := range from {
+			var comments []string
+			if f.restoreComments {
+				comments = append(comments, restoreComment(m))
+			}
+			namespace := namespaceOf(m, f.namespace)
+			target := fmt.Sprintf("%s %s", resourceType(m), m.Name)
+			if selector, found := selectors[selectorGroup(m, f.namespace)]; found {
+				if i, found := selectorBlocks[selectorGroup(m, f.namespace)]; found {
+					// the resource is deleted by the selector of an earlier block, which only
+					// needs its comments in front of the deletion
+					block := blocks[i]
+					blocks[i] = append(append(block[:len(block)-1:len(block)-1], comments...), block[len(block)-1])
+					continue
+				}
+				selectorBlocks[selectorGroup(m, f.namespace)] = len(blocks)
+				target = fmt.Sprintf("%s -l %s", resourceType(m), selector)
+			}
+			namespaces = append(namespaces, namespace)
+			var rendered strings.Builder
+			err := command.Execute(&rendered, commandData{
+				APIVersion: m.APIVersion,
+				Kind:       m.Kind,
+				Name:       m.Name,
+				Namespace:  namespace,
+				Command:    kubectl(f, contexts, "delete", namespace),
+				Target:     target,
+			})
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to render command template: %v", err)
+			}
+			deletion := rendered.String()
+			if f.reportFailures {
+				deletion = withFailureReport(f, deletion, target, namespace)
+			}
+			get := fmt.Sprintf("%s %s", kubectl(f, contexts, "get", namespace), target)
+			block := comments
+			var conditions []string
+			if f.byUID && len(m.UID) == 0 {
+				block = append(block, fmt.Sprintf("# WARN - no uid recorded for %s %s, deleting it without checking the uid", m.Kind, m.Name))
+			} else if f.byUID {
+				conditions = append(conditions, fmt.Sprintf(`[ "$(%s -o jsonpath='{.metadata.uid}')" = "%s" ]`, get, m.UID))
+			}
+			if len(labelKey) > 0 {
+				conditions = append(conditions, fmt.Sprintf(`[ "$(%s -o jsonpath='{.metadata.labels.%s}')" = "%s" ]`, get, strings.ReplaceAll(labelKey, ".", `\.`), labelValue))
+			}
+			if len(conditions) == 0 {
+				blocks = append(blocks, append(block, deletion))
+			} else {
+				blocks = append(blocks, append(block, fmt.Sprintf("if %s; then", strings.Join(conditions, " && ")), "  "+deletion, "fi"))
+			}
+		}
+	}
+	if f.functions {
+		blocks = namespaceFunctions(f, namespaces, blocks)
+	}
+
+	return scriptHeader(f), blocks, nil
+}
+
+// shebangLine returns the shebang of the script, prepending the #! if it was left out.
+func shebangLine(shebang string) string {
+	if len(shebang) == 0 {
+		return defaultShebang
+	}
+	if !strings.HasPrefix(shebang, "#!") {
+		return "#!" + shebang
+	}
+	return shebang
+}
+
+// strictMode returns the set command aborting the script on the first failure, pipefail is
+// left out for shells other than bash, like dash, which don't support it.
+func strictMode(shebang string) string {
+	if strings.Contains(shebangLine(shebang), "bash") {
+		return "set -euo pipefail"
+	}
+	return "set -eu"
+}
+
+// commandData is passed to the -command-template for every deletion.
+type commandData struct {
+	APIVersion string
+	Kind       string
+	Name       string
+	Namespace  string
+
+	// Command is the kubectl delete command with its flags and Target the resource type
+	// and name, or label selector, to be deleted
+	Command string
+	Target  string
+}
+
+func scriptHeader(f flags) []string {
+	var header []string
+	if f.shell == shellPowerShell {
+		if f.strict {
+			// stop on errors of kubectl as well, not only on those of cmdlets
+			header = append(header, `$ErrorActionPreference = "Stop"`, "$PSNativeCommandUseErrorActionPreference = $true", "")
+		}
+		return header
+	}
+	// a fragment embedded in another script keeps the error handling of that script
+	if !f.noShebang {
+		header = append(header, shebangLine(f.shebang))
+		if f.strict {
+			header = append(header, strictMode(f.shebang))
+		}
+		header = append(header, "")
+	}
+	if f.emitHeaderEnv {
+		header = append(header, fmt.Sprintf(`NAMESPACE="${NAMESPACE:-%s}"`, f.namespace), "")
+	}
+	return header
+}
+
+// withFailureReport makes the deletion print which resources it failed to delete, the
+// script is aborted in strict mode and continues otherwise.
+func withFailureReport(f flags, deletion, target, namespace string) string {
+	message := "failed to delete " + target
+	if len(namespace) > 0 {
+		message += " in namespace " + namespace
+	}
+	if f.strict {
+		return fmt.Sprintf(`%s || { echo "%s" >&2; exit 1; }`, deletion, message)
+	}
+	return fmt.Sprintf(`%s || echo "%s" >&2`, deletion, message)
+}
+
+// namespaceFunctions groups the blocks into one bash function per namespace, so operators
+// can run namespaces selectively, followed by the invocation of all functions. The result is
+// a single block, the pauses of -sleep are placed inside the functions.
+func namespaceFunctions(f flags, namespaces []string, blocks [][]string) [][]string {
+	var order []string
+	bodies := make(map[string][]string)
+	for i, block := range blocks {
+		namespace := namespaces[i]
+		if _, found := bodies[namespace]; !found {
+			order = append(order, namespace)
+		} else if f.sleep > 0 {
+			bodies[namespace] = append(bodies[namespace], "  "+sleepCommand(f))
+		}
+		for _, line := range block {
+			bodies[namespace] = append(bodies[namespace], "  "+line)
+		}
+	}
+	var script []string
+	for _, namespace := range order {
+		script = append(script, functionName(namespace)+"() {")
+		script = append(script, bodies[namespace]...)
+		script = append(script, "}", "")
+	}
+	for _, namespace := range order {
+		script = append(script, functionName(namespace))
+	}
+	return [][]string{script}
+}
+
+var nonIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+func functionName(namespace string) string {
+	if len(namespace) == 0 {
+		return "cleanup_cluster_scoped"
+	}
+	return "cleanup_" + nonIdentifier.ReplaceAllString(namespace, "_")
+}
+
+// withStatefulSetClaims inserts the PersistentVolumeClaims created from the volume claim
+// templates of each StatefulSet after it. Kubernetes retains these claims when a
+// StatefulSet is deleted, they are named <template>-<statefulset>-<ordinal>.
+func withStatefulSetClaims(manifests []manifest.Resource) []manifest.Resource {
+	var results []manifest.Resource
+	for _, m := range manifests {
+		results = append(results, m)
+		if !strings.EqualFold(m.Kind, "StatefulSet") {
+			continue
+		}
+		for _, template := range m.ClaimTemplates {
+			for ordinal := 0; ordinal < m.Replicas; ordinal++ {
+				results = append(results, manifest.Resource{
+					APIVersion: "v1",
+					Kind:       "PersistentVolumeClaim",
+					Name:       fmt.Sprintf("%s-%s-%d", template, m.Name, ordinal),
+					Namespace:  m.Namespace,
+				})
+			}
+		}
+	}
+	return results
+}
+
+func selectorGroup(m manifest.Resource, namespace string) string {
+	return manifest.SimpleKind(m) + "|" + namespaceOf(m, namespace)
+}
+
+// commonLabelSelectors returns label selectors, keyed by kind and namespace, for groups of at
+// least two orphans sharing labels. A selector is only used if it matches exactly the orphans
+// of its group and none of the other resources of both manifests.
+func commonLabelSelectors(orphaned []manifest.Resource, from, to map[string]manifest.Resource, namespace string) map[string]string {
+	groups := make(map[string][]manifest.Resource)
+	for _, m := range orphaned {
+		groups[selectorGroup(m, namespace)] = append(groups[selectorGroup(m, namespace)], m)
+	}
+	isOrphan := make(map[string]bool)
+	for _, m := range orphaned {
+		isOrphan[selectorGroup(m, namespace)+"|"+m.Name] = true
+	}
+
+	selectors := make(map[string]string)
+	for group, members := range groups {
+		if len(members) < 2 {
+			continue
+		}
+		common := make(map[string]string)
+		for k, v := range members[0].Labels {
+			common[k] = v
+		}
+		for _, m := range members[1:] {
+			for k, v := range common {
+				if m.Labels[k] != v {
+					delete(common, k)
+				}
+			}
+		}
+		if len(common) == 0 {
+			continue
+		}
+		specific := true
+		for _, resources := range []map[string]manifest.Resource{from, to} {
+			for _, r := range resources {
+				if selectorGroup(r, namespace) == group && !isOrphan[group+"|"+r.Name] && matchesLabels(r, common) {
+					specific = false
+				}
+			}
+		}
+		if !specific {
+			continue
+		}
+		var selector []string
+		for k, v := range common {
+			selector = append(selector, k+"="+v)
+		}
+		sort.Strings(selector)
+		selectors[group] = strings.Join(selector, ",")
+	}
+	return selectors
+}
+
+func matchesLabels(m manifest.Resource, labels map[string]string) bool {
+	for k, v := range labels {
+		if value, found := m.Labels[k]; !found || value != v {
+			return false
+		}
+	}
+	return true
+}
+
+// batchDeletions groups the resources by namespace into a single kubectl invocation each,
+// which reads the kind/name records from stdin.
+func batchDeletions(f flags, contexts map[string]string, from []manifest.Resource) ([][]string, []string) {
+	var namespaces []string
+	records := make(map[string][]string)
+	comments := make(map[string][]string)
+	for _, m := range from {
+		namespace := namespaceOf(m, f.namespace)
+		if _, found := records[namespace]; !found {
+			namespaces = append(namespaces, namespace)
+		}
+		records[namespace] = append(records[namespace], fmt.Sprintf("%s/%s", resourceType(m), m.Name))
+		if f.restoreComments {
+			comments[namespace] = append(comments[namespace], restoreComment(m))
+		}
+	}
+	var blocks [][]string
+	for _, namespace := range namespaces {
+		block := append(comments[namespace], fmt.Sprintf("xargs %s <<'EOF'", kubectl(f, contexts, "delete", namespace)))
+		block = append(block, records[namespace]...)
+		blocks = append(blocks, append(block, "EOF"))
+	}
+	return blocks, namespaces
+}
+
+// optimizedDeletions groups the resources by namespace into a block each, which sets the
+// namespace once, only runs if the namespace still exists and deletes all resources of a
+// kind with a single kubectl invocation. Cluster-scoped resources get an unguarded block.
+func optimizedDeletions(f flags, contexts map[string]string, from []manifest.Resource) ([][]string, []string) {
+	var namespaces []string
+	types := make(map[string][]string)
+	names := make(map[string]map[string][]string)
+	comments := make(map[string][]string)
+	for _, m := range from {
+		namespace := namespaceOf(m, f.namespace)
+		if _, found := names[namespace]; !found {
+			namespaces = append(namespaces, namespace)
+			names[namespace] = make(map[string][]string)
+		}
+		if _, found := names[namespace][resourceType(m)]; !found {
+			types[namespace] = append(types[namespace], resourceType(m))
+		}
+		names[namespace][resourceType(m)] = append(names[namespace][resourceType(m)], m.Name)
+		if f.restoreComments {
+			comments[namespace] = append(comments[namespace], restoreComment(m))
+		}
+	}
+	var blocks [][]string
+	for _, namespace := range namespaces {
+		block := comments[namespace]
+		if len(namespace) == 0 {
+			for _, resourceType := range types[namespace] {
+				block = append(block, fmt.Sprintf("%s %s %s", kubectl(f, contexts, "delete", ""), resourceType, strings.Join(names[namespace][resourceType], " ")))
+			}
+			blocks = append(blocks, block)
+			continue
+		}
+		reference := namespace
+		if f.emitHeaderEnv && namespace == f.namespace {
+			reference = `"$NAMESPACE"`
+		}
+		context := contextOf(f, contexts, namespace)
+		block = append(block,
+			fmt.Sprintf("ns=%s", reference),
+			fmt.Sprintf(`if %s namespace "$ns" >/dev/null 2>&1; then`, kubectlCommand(f, context, "get", "")))
+		for _, resourceType := range types[namespace] {
+			block = append(block, fmt.Sprintf("  %s %s %s", kubectlCommand(f, context, "delete", `"$ns"`), resourceType, strings.Join(names[namespace][resourceType], " ")))
+		}
+		blocks = append(blocks, append(block, "fi"))
+	}
+	return blocks, namespaces
+}
+
+func restoreComment(m manifest.Resource) string {
+	return fmt.Sprintf("# to restore: apply manifest for %s %s %s", m.APIVersion, m.Kind, m.Name)
+}
+
+// kubectl returns the kubectl command running verb on resources of the given namespace.
+func kubectl(f flags, contexts map[string]string, verb, namespace string) string {
+	context := contextOf(f, contexts, namespace)
+	if f.emitHeaderEnv && namespace == f.namespace {
+		namespace = `"$NAMESPACE"`
+	}
+	return kubectlCommand(f, context, verb, namespace)
+}
+
+// contextOf returns the kubeconfig context of the deletions in the given namespace.
+func contextOf(f flags, contexts map[string]string, namespace string) string {
+	if context, found := contexts[namespace]; found {
+		return context
+	}
+	return f.context
+}
+
+// kubectlCommand returns the kubectl command running verb in the given context and
+// namespace, which may also be a shell variable reference.
+func kubectlCommand(f flags, context, verb, namespace string) string {
+	command := "kubectl " + verb
+	if len(context) > 0 {
+		command += " --context=" + context
+	}
+	if len(namespace) > 0 {
+		command += " -n " + namespace
+	}
+	if verb == "delete" {
+		if f.ignoreNotFound {
+			command += " --ignore-not-found"
+		}
+		if len(f.gracePeriod) > 0 {
+			command += " --grace-period=" + f.gracePeriod
+		}
+		if f.now {
+			command += " --now"
+		}
+		if f.forceDelete {
+			command += " --force"
+		}
+		if f.timeout > 0 {
+			command += " --timeout=" + f.timeout.String()
+		}
+		if len(f.wait) > 0 {
+			command += " --wait=" + f.wait
+		}
+		if len(f.dryRun) > 0 {
+			command += " --dry-run=" + f.dryRun
+		}
+	}
+	return command
+}
+
+func namespaceOf(m manifest.Resource, defaultNamespace string) string {
+	return manifest.EffectiveNamespace(m, defaultNamespace)
+}
+
+// resourceType returns the plural resource type of m as used by kubectl.
+func resourceType(m manifest.Resource) string {
+	m.Kind = pluralKind(m.Kind)
+	return manifest.SimpleKind(m)
+}
+
+// irregularPlurals lists the resource names of kinds not following the pluralization rules.
+var irregularPlurals = map[string]string{
+	"endpoints":                  "endpoints",
+	"securitycontextconstraints": "securitycontextconstraints",
+}
+
+// pluralKind returns the lowercase resource name of a kind as Kubernetes derives it.
+func pluralKind(kind string) string {
+	kind = strings.ToLower(kind)
+	if plural, found := irregularPlurals[kind]; found {
+		return plural
+	}
+	switch {
+	case strings.HasSuffix(kind, "s"), strings.HasSuffix(kind, "x"), strings.HasSuffix(kind, "z"),
+		strings.HasSuffix(kind, "ch"), strings.HasSuffix(kind, "sh"):
+		return kind + "es"
+	case strings.HasSuffix(kind, "y") && len(kind) > 1 && !strings.ContainsRune("aeiou", rune(kind[len(kind)-2])):
+		return kind[:len(kind)-1] + "ies"
+	}
+	return kind + "s"
+}
+
+// workloadKinds are the lowercase kinds of the built-in workloads.
+var workloadKinds = map[string]bool{
+	"cronjob":               true,
+	"daemonset":             true,
+	"deployment":            true,
+	"job":                   true,
+	"pod":                   true,
+	"replicaset":            true,
+	"replicationcontroller": true,
+	"statefulset":           true,
+}
+
+// deleteWorkloadsBeforeServices moves the Services behind the last workload, so their
+// endpoints don't dangle while the workloads backing them are still terminating.
+func deleteWorkloadsBeforeServices(manifests []manifest.Resource) []manifest.Resource {
+	var services, others []manifest.Resource
+	lastWorkload := -1
+	for _, m := range manifests {
+		if strings.EqualFold(m.Kind, "Service") && m.APIVersion == "v1" {
+			services = append(services, m)
+			continue
+		}
+		others = append(others, m)
+		if workloadKinds[strings.ToLower(m.Kind)] {
+			lastWorkload = len(others) - 1
+		}
+	}
+	if lastWorkload < 0 || len(services) == 0 {
+		return manifests
+	}
+	sorted := append([]manifest.Resource(nil), others[:lastWorkload+1]...)
+	sorted = append(sorted, services...)
+	return append(sorted, others[lastWorkload+1:]...)
+}
+
+// builtinGroups lists the API groups of the kinds built into Kubernetes, resources of any
+// other group are custom resources.
+var builtinGroups = map[string]bool{
+	"":                             true,
+	"admissionregistration.k8s.io": true,
+	"apiextensions.k8s.io":         true,
+	"apiregistration.k8s.io":       true,
+	"apps":                         true,
+	"autoscaling":                  true,
+	"batch":                        true,
+	"certificates.k8s.io":          true,
+	"coordination.k8s.io":          true,
+	"discovery.k8s.io":             true,
+	"events.k8s.io":                true,
+	"flowcontrol.apiserver.k8s.io": true,
+	"networking.k8s.io":            true,
+	"node.k8s.io":                  true,
+	"policy":                       true,
+	"rbac.authorization.k8s.io":    true,
+	"scheduling.k8s.io":            true,
+	"storage.k8s.io":               true,
+}
+
+// kindPriorities ranks the built-in kinds other resources depend on, by simple kind.
+// Built-in kinds not listed are ranked like workloads.
+var kindPriorities = map[string]int{
+	"serviceaccount":                               2,
+	"role.rbac.authorization.k8s.io":               2,
+	"rolebinding.rbac.authorization.k8s.io":        2,
+	"clusterrole.rbac.authorization.k8s.io":        2,
+	"clusterrolebinding.rbac.authorization.k8s.io": 2,
+	"configmap":             3,
+	"secret":                3,
+	"persistentvolumeclaim": 3,
+	"persistentvolume":      4,
+	"customresourcedefinition.apiextensions.k8s.io": 5,
+	"namespace": 6,
+}
+
+// sortByKindPriority sorts the resources so custom resources are deleted first, followed
+// by workloads and other built-in kinds, then their accounts, configuration and storage,
+// and finally the CustomResourceDefinitions and Namespaces. Resources of the same rank
+// keep their order.
+func sortByKindPriority(manifests []manifest.Resource) []manifest.Resource {
+	rank := func(m manifest.Resource) int {
+		if r, found := kindPriorities[manifest.SimpleKind(m)]; found {
+			return r
+		}
+		if group, _ := splitAPIVersion(m.APIVersion); !builtinGroups[group] {
+			return 0
+		}
+		return 1
+	}
+	sorted := append([]manifest.Resource(nil), manifests...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+	return sorted
+}
+
+// readDeletionOrder reads the ranks of the kinds listed in an order file. Empty lines and
+// lines starting with '#' are skipped.
+func readDeletionOrder(filePath string) (map[string]int, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read order file at '%v': %v", filePath, err)
+	}
+	order := make(map[string]int)
+	for _, line := range strings.Split(string(content), "\n") {
+		kind := strings.ToLower(strings.TrimSpace(line))
+		if len(kind) == 0 || strings.HasPrefix(kind, "#") {
+			continue
+		}
+		if _, found := order[kind]; !found {
+			order[kind] = len(order)
+		}
+	}
+	return order, nil
+}
+
+// sortByDeletionOrder sorts the resources by the rank of their kind, either given as
+// simple kind or qualified with its group. Unranked kinds keep their order at the end.
+func sortByDeletionOrder(manifests []manifest.Resource, order map[string]int) []manifest.Resource {
+	rank := func(m manifest.Resource) int {
+		if r, found := order[manifest.SimpleKind(m)]; found {
+			return r
+		}
+		if r, found := order[strings.ToLower(m.Kind)]; found {
+			return r
+		}
+		return len(order)
+	}
+	sorted := append([]manifest.Resource(nil), manifests...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return rank(sorted[i]) < rank(sorted[j])
+	})
+	return sorted
+}
+
+// parseContextMap parses a list of namespace=context pairs.
+func parseContextMap(contextMap string) (map[string]string, error) {
+	contexts := make(map[string]string)
+	if len(contextMap) == 0 {
+		return contexts, nil
+	}
+	for _, entry := range strings.Split(contextMap, ",") {
+		pair := strings.Split(entry, "=")
+		if len(pair) != 2 || len(pair[0]) == 0 || len(pair[1]) == 0 {
+			return nil, fmt.Errorf("invalid context mapping format: %v", entry)
+		}
+		contexts[pair[0]] = pair[1]
+	}
+	return contexts, nil
+}
+
+type reportEntry struct {
+	APIVersion string `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string `json:"kind" yaml:"kind"`
+	Name       string `json:"name" yaml:"name"`
+	Namespace  string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Extras      map[string]string `json:"extras,omitempty" yaml:"extras,omitempty"`
+	Severity    string            `json:"severity,omitempty" yaml:"severity,omitempty"`
+}
+
+// toReport returns the report entries of the resources, rated by the severities unless they
+// are nil.
+func toReport(manifests []manifest.Resource, includeAnnotations bool, severities map[string]string) []reportEntry {
+	report := make([]reportEntry, 0, len(manifests))
+	for _, m := range manifests {
+		entry := reportEntry{
+			APIVersion: m.APIVersion,
+			Kind:       m.Kind,
+			Name:       m.Name,
+			Namespace:  m.Namespace,
+			Extras:     m.Extras,
+		}
+		if severities != nil {
+			entry.Severity = severityOf(m, severities)
+		}
+		if includeAnnotations {
+			entry.Annotations = m.Annotations
+		}
+		report = append(report, entry)
+	}
+	return report
+}
+
+func writeReport(out io.Writer, f flags, manifests []manifest.Resource, severities map[string]string) error {
+	withName := f.reportFile
+	content, err := json.MarshalIndent(toReport(manifests, f.includeAnnotations, severities), "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal report: %v", err)
+	}
+	if err = os.WriteFile(withName, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("unable to write report file: %v", err)
+	}
+	_, err = fmt.Fprintf(out, "Report created: '%s'\n", withName)
+	return err
+}
+
+// writePrunedManifest writes the documents of the from manifest which are not orphaned,
+// keeping their original text, comments and order.
+func writePrunedManifest(out io.Writer, f flags, orphaned []manifest.Resource) error {
+	withName := f.pruneOutput
+	documents, err := manifestDocuments(f, f.fromFile)
+	if err != nil {
+		return err
+	}
+	orphans := make(map[string]bool, len(orphaned))
+	for _, m := range orphaned {
+		orphans[manifest.ResourceKey(m, f.namespace)] = true
+	}
+	var prunedDocuments strings.Builder
+	for _, document := range documents {
+		var orphan, kept []string
+		for _, key := range keysByIndex(document.resources) {
+			if orphans[key] {
+				orphan = append(orphan, key)
+			} else {
+				kept = append(kept, key)
+			}
+		}
+		if len(orphan) == 0 {
+			prunedDocuments.WriteString(document.text)
+			continue
+		}
+		if len(kept) > 0 {
+			// the document is kept as written, a List or array can't lose single items
+			m := document.resources[orphan[0]]
+			return fmt.Errorf("unable to prune %s %s, its document also declares resources which are kept, split it into one document per resource", m.Kind, m.Name)
+		}
+	}
+	if err = os.WriteFile(withName, []byte(prunedDocuments.String()), 0644); err != nil {
+		return fmt.Errorf("unable to write pruned manifest: %v", err)
+	}
+	_, err = fmt.Fprintf(out, "Pruned manifest created: '%s'\n", withName)
+	return err
+}
+
+type manifestDocument struct {
+	text      string
+	resources map[string]manifest.Resource
+}
+
+// manifestDocuments returns the documents of the comma separated manifest sources as they
+// are written, along with the resources each of them declares.
+func manifestDocuments(f flags, sources string) ([]manifestDocument, error) {
+	locations, err := sourceLocations(sources)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := readSources(locations)
+	if err != nil {
+		return nil, err
+	}
+	var documents []manifestDocument
+	for _, text := range splitDocuments(strings.Join(contents, "\n---\n")) {
+		resources, _, err := manifest.Parse(io.Discard, text, f.onMissingKind, f.namespace)
+		if err != nil {
+			return nil, err
+		}
+		if len(f.namespaceLabel) > 0 {
+			resources = namespacesFromLabel(resources, f.namespaceLabel, f.namespace)
+		}
+		documents = append(documents, manifestDocument{text: text, resources: resources})
+	}
+	return documents, nil
+}
+
+// writeApplyScript writes a script applying the documents of the to manifest which declare
+// resources added by the upgrade.
+func writeApplyScript(out io.Writer, f flags, added []manifest.Resource) error {
+	contexts, err := parseContextMap(f.contextMap)
+	if err != nil {
+		return err
+	}
+	documents, err := manifestDocuments(f, f.toFile)
+	if err != nil {
+		return err
+	}
+	isAdded := make(map[string]bool, len(added))
+	for _, m := range added {
+		isAdded[manifest.ResourceKey(m, f.namespace)] = true
+	}
+	lines := scriptHeader(f)
+	for _, document := range documents {
+		for _, key := range keysByIndex(document.resources) {
+			if !isAdded[key] {
+				continue
+			}
+			m := document.resources[key]
+			text := strings.TrimRight(document.text, "\r\n")
+			if i := strings.Index(text, "\n"); strings.HasPrefix(text, "---") && i > 0 {
+				text = text[i+1:]
+			}
+			lines = append(lines,
+				fmt.Sprintf("# added: %s %s %s", m.APIVersion, m.Kind, m.Name),
+				fmt.Sprintf("%s -f - <<'MANIFEST'", kubectl(f, contexts, "apply", namespaceOf(m, f.namespace))),
+				text,
+				"MANIFEST")
+			break
+		}
+	}
+	if info, err := os.Stat(f.applyOutput); err == nil && info.IsDir() {
+		return fmt.Errorf("output path '%s' is a directory, specify the file name of the script to be created", f.applyOutput)
+	}
+	if err := os.WriteFile(f.applyOutput, []byte(strings.Join(lines, "\n")+"\n"), 0755); err != nil {
+		return fmt.Errorf("unable to write apply script: %v", err)
+	}
+	_, err = fmt.Fprintf(out, "Apply script created: '%s'\n", f.applyOutput)
+	return err
+}
+
+// splitDocuments splits a YAML stream into its documents, each one starting with its
+// separator line if it has one.
+func splitDocuments(content string) []string {
+	var documents []string
+	var document strings.Builder
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if (trimmed == "---" || strings.HasPrefix(trimmed, "--- ")) && document.Len() > 0 {
+			documents = append(documents, document.String())
+			document.Reset()
+		}
+		document.WriteString(line)
+	}
+	if document.Len() > 0 {
+		documents = append(documents, document.String())
+	}
+	return documents
+}
+
+// readSeverities returns the default severities overridden by the YAML file at filePath,
+// which maps kinds to severities:
+//
+//	configmap: warning
+//	servicemonitor.monitoring.coreos.com: critical
+func readSeverities(filePath string) (map[string]string, error) {
+	severities := make(map[string]string, len(defaultSeverities))
+	for kind, severity := range defaultSeverities {
+		severities[kind] = severity
+	}
+	if len(filePath) == 0 {
+		return severities, nil
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read severity file at '%v': %v", filePath, err)
+	}
+	overrides := make(map[string]string)
+	if err := yaml.Unmarshal(content, &overrides); err != nil {
+		return nil, fmt.Errorf("unable to parse severity file '%v': %v", filePath, err)
+	}
+	for kind, severity := range overrides {
+		switch severity {
+		case severityInfo, severityWarning, severityCritical:
+		default:
+			return nil, fmt.Errorf("unsupported severity of %v in '%v': %v", kind, filePath, severity)
+		}
+		severities[strings.ToLower(kind)] = severity
+	}
+	return severities, nil
+}
+
+// severityOf returns the severity of deleting m, looked up by its kind qualified by its
+// group first.
+func severityOf(m manifest.Resource, severities map[string]string) string {
+	if severity, found := severities[manifest.SimpleKind(m)]; found {
+		return severity
+	}
+	if severity, found := severities[strings.ToLower(m.Kind)]; found {
+		return severity
+	}
+	return severityInfo
+}
+
+// severitySuffix marks the summary line of m with its severity, unless deleting m is of
+// severityInfo.
+func severitySuffix(m manifest.Resource, severities map[string]string) string {
+	severity := severityOf(m, severities)
+	if severity == severityInfo {
+		return ""
+	}
+	return " [" + severity + "]"
+}
+
+func printJSONSummary(out io.Writer, f flags, manifests []manifest.Resource, severities map[string]string) error {
+	content, err := json.MarshalIndent(toReport(manifests, f.includeAnnotations, severities), "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal summary: %v", err)
+	}
+	_, err = fmt.Fprintf(out, "%s\n", content)
+	return err
+}
+
+func printYAMLResources(out io.Writer, f flags, manifests []manifest.Resource, severities map[string]string) error {
+	content, err := yaml.Marshal(toReport(manifests, f.includeAnnotations, severities))
+	if err != nil {
+		return fmt.Errorf("unable to marshal resources: %v", err)
+	}
+	_, err = out.Write(content)
+	return err
+}
+
+func printTableSummary(out io.Writer, manifests []manifest.Resource, namespace string, severities map[string]string) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "KIND\tNAMESPACE\tNAME\tAPIVERSION\tSEVERITY\n")
+	for _, m := range manifests {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", m.Kind, namespaceOf(m, namespace), m.Name, m.APIVersion, severityOf(m, severities))
+	}
+	return w.Flush()
+}
+
+// printNarrative describes the resources removed by the upgrade in prose, one sentence per namespace.
+func printNarrative(out io.Writer, manifests []manifest.Resource, defaultNamespace string) {
+	var namespaces []string
+	var kinds = make(map[string][]string)
+	var counts = make(map[string]map[string]int)
+	for _, m := range manifests {
+		namespace := namespaceOf(m, defaultNamespace)
+		if _, found := counts[namespace]; !found {
+			namespaces = append(namespaces, namespace)
+			counts[namespace] = make(map[string]int)
+		}
+		if counts[namespace][m.Kind] == 0 {
+			kinds[namespace] = append(kinds[namespace], m.Kind)
+		}
+		counts[namespace][m.Kind]++
+	}
+	sort.Strings(namespaces)
+
+	for _, namespace := range namespaces {
+		var parts []string
+		for _, kind := range kinds[namespace] {
+			parts = append(parts, pluralizer.Pluralize(kind, counts[namespace][kind], true))
+		}
+		removed := parts[0]
+		if len(parts) > 1 {
+			removed = strings.Join(parts[:len(parts)-1], ", ") + " and " + parts[len(parts)-1]
+		}
+		if len(namespace) == 0 {
+			fmt.Fprintf(out, "This upgrade removes %s from the cluster.\n", removed)
+			continue
+		}
+		fmt.Fprintf(out, "This upgrade removes %s from the %s namespace.\n", removed, namespace)
+	}
+}
+
+type argoCDResource struct {
+	Group     string `yaml:"group"`
+	Version   string `yaml:"version"`
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace,omitempty"`
+	Name      string `yaml:"name"`
+}
+
+func printArgoCDResources(out io.Writer, manifests []manifest.Resource, namespace string) error {
+	var resources []argoCDResource
+	for _, m := range manifests {
+		group, version := splitAPIVersion(m.APIVersion)
+		resources = append(resources, argoCDResource{
+			Group:     group,
+			Version:   version,
+			Kind:      m.Kind,
+			Namespace: namespaceOf(m, namespace),
+			Name:      m.Name,
+		})
+	}
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(map[string][]argoCDResource{"resources": resources}); err != nil {
+		return fmt.Errorf("unable to encode resources: %v", err)
+	}
+	return encoder.Close()
+}
+
+// splitAPIVersion returns the group and version of apiVersion, the group of the core API is empty.
+func splitAPIVersion(apiVersion string) (string, string) {
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		return apiVersion[:i], apiVersion[i+1:]
+	}
+	return "", apiVersion
+}
+
+// isTextOutput reports whether the resources are printed as plain text, which other
+// reports can be interleaved with.
+func isTextOutput(f flags) bool {
+	return (len(f.format) == 0 || f.format == formatText) && (len(f.summaryFormat) == 0 || f.summaryFormat == formatText)
+}
+
+// printVersionChanges prints the resources which are kept by the upgrade under a different
+// apiVersion, they are migrated rather than deleted.
+func printVersionChanges(out io.Writer, changes []manifest.VersionChange) {
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "Resources changing their apiVersion with the upgrade:\n")
+	for _, change := range changes {
+		fmt.Fprintf(out, "%s -> %s\n", change.Resource, change.ToAPIVersion)
+	}
+}
+
+func printUnchanged(out io.Writer, manifests []manifest.Resource) {
+	fmt.Fprintf(out, "Resources present in both manifests:\n")
+	for _, m := range manifests {
+		fmt.Fprintf(out, "%+v\n", m)
+	}
+}
+
+// printKindsReport prints every distinct kind of both manifests, qualified by its group,
+// with the number of resources of the kind in each manifest.
+func printKindsReport(out io.Writer, from, to map[string]manifest.Resource) error {
+	counts := make(map[string][2]int)
+	for i, manifests := range []map[string]manifest.Resource{from, to} {
+		for _, m := range manifests {
+			c := counts[manifest.SimpleKind(m)]
+			c[i]++
+			counts[manifest.SimpleKind(m)] = c
+		}
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprintf(out, "Kinds seen in the manifests:\n")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "KIND\tFROM\tTO\n")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", kind, counts[kind][0], counts[kind][1])
+	}
+	return w.Flush()
+}
+
+// extrasSuffix describes the extras of a resource for the text summary, e.g. " (3 replicas)".
+func extrasSuffix(m manifest.Resource) string {
+	if len(m.Extras) == 0 {
+		return ""
+	}
+	fields := make([]string, 0, len(m.Extras))
+	for field := range m.Extras {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	details := make([]string, 0, len(fields))
+	for _, field := range fields {
+		if field == "replicas" {
+			details = append(details, m.Extras[field]+" replicas")
+		} else {
+			details = append(details, field+" "+m.Extras[field])
+		}
+	}
+	return " (" + strings.Join(details, ", ") + ")"
+}
+
+func printSummary(out io.Writer, manifests []manifest.Resource, deprecated map[string]bool, severities map[string]string) {
+	if len(manifests) == 0 {
+		return
+	}
+	var orphaned []manifest.Resource
+	var deprecatedKinds []string
+	byDeprecatedKind := make(map[string][]manifest.Resource)
+	for _, m := range manifests {
+		if !deprecated[strings.ToLower(m.Kind)] {
+			orphaned = append(orphaned, m)
+			continue
+		}
+		if _, found := byDeprecatedKind[m.Kind]; !found {
+			deprecatedKinds = append(deprecatedKinds, m.Kind)
+		}
+		byDeprecatedKind[m.Kind] = append(byDeprecatedKind[m.Kind], m)
+	}
+
+	fmt.Fprintf(out, "%d resources to be deleted: %s\n", len(manifests), kindCounts(manifests))
+	if len(orphaned) > 0 {
+		fmt.Fprintf(out, "Resources to be deleted after upgrade:\n")
+		for _, m := range orphaned {
+			fmt.Fprintf(out, "%+v%s%s\n", m, extrasSuffix(m), severitySuffix(m, severities))
+		}
+	}
+	for _, kind := range deprecatedKinds {
+		fmt.Fprintf(out, "Deprecated kind %s is no longer part of the upgrade, resources to be deleted:\n", kind)
+		for _, m := range byDeprecatedKind[kind] {
+			fmt.Fprintf(out, "%+v%s%s\n", m, extrasSuffix(m), severitySuffix(m, severities))
+		}
+	}
+
+	var withFinalizers int
+	for _, m := range manifests {
+		if len(m.Finalizers) > 0 {
+			withFinalizers++
+		}
+	}
+	if withFinalizers > 0 {
+		fmt.Fprintf(out, "Note: %d of %d resources to be deleted have finalizers and might get stuck in deletion\n", withFinalizers, len(manifests))
+	}
+}
+
+// kindCounts returns the number of resources per kind, in alphabetical order of the kinds,
+// e.g. "ConfigMap: 3, Service: 2".
+func kindCounts(manifests []manifest.Resource) string {
+	counts := make(map[string]int)
+	for _, m := range manifests {
+		counts[m.Kind]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%s: %d", kind, counts[kind])
+	}
+	return strings.Join(kinds, ", ")
+}
+
+// emptiedNamespaces returns the namespaces, in alphabetical order, whose resources of both
+// manifests are all deleted.
+func emptiedNamespaces(orphaned []manifest.Resource, from, to map[string]manifest.Resource, defaultNamespace string) []string {
+	deleted := make(map[string]int)
+	for _, m := range orphaned {
+		if namespace := namespaceOf(m, defaultNamespace); len(namespace) > 0 {
+			deleted[namespace]++
+		}
+	}
+	for _, m := range to {
+		delete(deleted, namespaceOf(m, defaultNamespace))
+	}
+	for _, m := range from {
+		deleted[namespaceOf(m, defaultNamespace)]--
+	}
+	var emptied []string
+	for namespace, remaining := range deleted {
+		if remaining == 0 {
+			emptied = append(emptied, namespace)
+		}
+	}
+	sort.Strings(emptied)
+	return emptied
+}
+
+// deprecatedKinds returns the kinds found in left which are entirely absent from right.
+func deprecatedKinds(left, right map[string]manifest.Resource) map[string]bool {
+	remaining := make(map[string]bool)
+	for _, v := range right {
+		remaining[strings.ToLower(v.Kind)] = true
+	}
+	deprecated := make(map[string]bool)
+	for _, v := range left {
+		if kind := strings.ToLower(v.Kind); !remaining[kind] {
+			deprecated[kind] = true
+		}
 	}
-	return kind
+	return deprecated
 }
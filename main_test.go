@@ -2,11 +2,20 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+	"migrate/manifest"
 )
 
 func TestCLI(t *testing.T) {
@@ -16,6 +25,7 @@ func TestCLI(t *testing.T) {
 		toFile         string
 		outputFile     string
 		ignored        string
+		noShebang      bool
 		expectedOutput string
 	}{
 		{
@@ -32,9 +42,9 @@ func TestCLI(t *testing.T) {
 			expectedOutput: `#!/usr/bin/env bash
 
 kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
-kubectl delete -n kyma-system clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
 kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
-kubectl delete -n kyma-system podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
 kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
 `,
 		},
@@ -47,8 +57,21 @@ kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeg
 			expectedOutput: `#!/usr/bin/env bash
 
 kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
-kubectl delete -n kyma-system clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
-kubectl delete -n kyma-system podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+`,
+		},
+		{
+			summary:    "two orphans after upgrade without shebang",
+			fromFile:   path.Join("testdata", "kyma-1.yaml"),
+			toFile:     path.Join("testdata", "kyma-2.yaml"),
+			outputFile: path.Join("testdata", "test-result.sh"),
+			noShebang:  true,
+			expectedOutput: `kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
 `,
 		},
 	}
@@ -61,6 +84,7 @@ kubectl delete -n kyma-system podsecuritypolicies.policy 002-kyma-privileged
 				toFile:     tc.toFile,
 				ignored:    tc.ignored,
 				outputFile: tc.outputFile,
+				noShebang:  tc.noShebang,
 			})
 			defer os.Remove(tc.outputFile)
 			require.NoError(t, err)
@@ -75,3 +99,3003 @@ kubectl delete -n kyma-system podsecuritypolicies.policy 002-kyma-privileged
 		})
 	}
 }
+
+func TestCanonicalKind(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: networking.k8s.io/v1
+kind: ingress.networking.k8s.io
+metadata:
+  name: foo
+`)
+	output := path.Join(dir, "cleanup.sh")
+
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps bar
+`, string(content))
+}
+
+func TestSleepBetweenDeletions(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		toFile:     path.Join("testdata", "kyma-2.yaml"),
+		ignored:    "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		outputFile: output,
+		sleep:      1500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+sleep 1.5
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestOutputIsDirectory(t *testing.T) {
+	dir := t.TempDir()
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		toFile:     path.Join("testdata", "kyma-2.yaml"),
+		outputFile: dir,
+	})
+	require.EqualError(t, err, "output path '"+dir+"' is a directory, specify the file name of the script to be created")
+}
+
+func TestContextMap(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: ns-a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: ns-b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+`)
+	output := path.Join(dir, "cleanup.sh")
+
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   from,
+		toFile:     to,
+		outputFile: output,
+		context:    "default-ctx",
+		contextMap: "ns-a=ctx-a,ns-b=ctx-b",
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete --context=ctx-a -n ns-a configmaps a
+kubectl delete --context=ctx-b -n ns-b configmaps b
+kubectl delete --context=default-ctx -n kyma-system configmaps c
+`, string(content))
+}
+
+func TestParseOnly(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile:  path.Join("testdata", "kyma-1.yaml"),
+		toFile:    path.Join("testdata", "kyma-2.yaml"),
+		parseOnly: true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, `Parsed 38 resources from 'testdata/kyma-1.yaml'
+Parsed 34 resources from 'testdata/kyma-2.yaml'
+`, buf.String())
+}
+
+func TestDeprecatedKindSummary(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: policy/v1beta1
+kind: PodSecurityPolicy
+metadata:
+  name: privileged
+---
+apiVersion: policy/v1beta1
+kind: PodSecurityPolicy
+metadata:
+  name: restricted
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{fromFile: from, toFile: to})
+	require.NoError(t, err)
+	require.Equal(t, `3 resources to be deleted: ConfigMap: 1, PodSecurityPolicy: 2
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:foo namespace:}
+Deprecated kind PodSecurityPolicy is no longer part of the upgrade, resources to be deleted:
+{apiVersion:policy/v1beta1 kind:PodSecurityPolicy name:privileged namespace:}
+{apiVersion:policy/v1beta1 kind:PodSecurityPolicy name:restricted namespace:}
+`, buf.String())
+}
+
+func TestReportAndScript(t *testing.T) {
+	dir := t.TempDir()
+	output := path.Join(dir, "cleanup.sh")
+	report := path.Join(dir, "report.json")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		toFile:     path.Join("testdata", "kyma-2.yaml"),
+		outputFile: output,
+		reportFile: report,
+	})
+	require.NoError(t, err)
+
+	script, err := os.ReadFile(output)
+	require.NoError(t, err)
+	content, err := os.ReadFile(report)
+	require.NoError(t, err)
+	var entries []reportEntry
+	require.NoError(t, json.Unmarshal(content, &entries))
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name)
+	}
+	require.Equal(t, []string{"tracing-jaeger", "cluster-essentials-pod-preset-webhook", "tracing-grafana-dashboard", "002-kyma-privileged", "tracing-jaeger-operator"}, names)
+	require.Equal(t, reportEntry{APIVersion: "v1", Kind: "ConfigMap", Name: "tracing-grafana-dashboard", Severity: severityInfo}, entries[2])
+	for _, name := range names {
+		require.Contains(t, string(script), " "+name+"\n")
+	}
+}
+
+func TestOrderFile(t *testing.T) {
+	dir := t.TempDir()
+	order := writeFile(t, dir, "order.txt", `# delete monitoring first
+servicemonitor.monitoring.coreos.com
+ConfigMap
+
+podsecuritypolicy
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		toFile:     path.Join("testdata", "kyma-2.yaml"),
+		outputFile: output,
+		orderFile:  order,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, string(content))
+}
+
+func TestSafeOnParseWarnings(t *testing.T) {
+	dir := t.TempDir()
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+- not
+- a
+- resource
+`)
+	output := path.Join(dir, "cleanup.sh")
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile:            path.Join("testdata", "kyma-1.yaml"),
+		toFile:              to,
+		outputFile:          output,
+		safeOnParseWarnings: true,
+	})
+	require.EqualError(t, err, "1 document(s) of '"+to+"' were skipped, refusing to look for orphans as the skipped resources might still be part of the upgrade")
+	require.Contains(t, buf.String(), "WARN - type error")
+	require.NoFileExists(t, output)
+}
+
+func TestStdinBatch(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: istio-system
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: b
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: c
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, stdinBatch: true})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+xargs kubectl delete -n istio-system <<'EOF'
+configmaps/a
+EOF
+xargs kubectl delete -n kyma-system <<'EOF'
+services/b
+servicemonitors.monitoring.coreos.com/c
+EOF
+`, string(content))
+}
+
+func TestReportAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: annotated
+  annotations:
+    owner: team-a
+    replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: plain
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+
+	for _, include := range []bool{true, false} {
+		report := path.Join(dir, "report.json")
+		err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, reportFile: report, includeAnnotations: include})
+		require.NoError(t, err)
+
+		content, err := os.ReadFile(report)
+		require.NoError(t, err)
+		var entries []reportEntry
+		require.NoError(t, json.Unmarshal(content, &entries))
+		require.Len(t, entries, 2)
+		if include {
+			require.Equal(t, map[string]string{"owner": "team-a", "replicas": "3"}, entries[0].Annotations)
+		} else {
+			require.NotContains(t, string(content), "annotations")
+		}
+		require.Nil(t, entries[1].Annotations)
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo-staging
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar-staging
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo-prod
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:                 from,
+		toFile:                   to,
+		outputFile:               output,
+		normalizeNameRegex:       "-(prod|staging)$",
+		normalizeNameReplacement: "-env",
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps bar-staging
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, normalizeNameRegex: "-(prod"})
+	require.EqualError(t, err, "invalid name normalization regex: error parsing regexp: missing closing ): `-(prod`")
+}
+
+func TestVerboseFunnel(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile: path.Join("testdata", "kyma-1.yaml"),
+		toFile:   path.Join("testdata", "kyma-2.yaml"),
+		ignored:  "servicemonitor.monitoring.coreos.com:tracing-jaeger-operator,configmap:tracing-grafana-dashboard",
+		verbose:  true,
+	})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(buf.String(), `Parsed 38 resources from 'testdata/kyma-1.yaml'
+Parsed 34 resources from 'testdata/kyma-2.yaml'
+Found 5 orphaned resources
+3 resources left after removing ignored resources
+3 resources to be deleted: AuthorizationPolicy: 1, ClusterRoleBinding: 1, PodSecurityPolicy: 1
+Resources to be deleted after upgrade:
+`), buf.String())
+}
+
+func TestArgoCDFormat(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile: path.Join("testdata", "kyma-1.yaml"),
+		toFile:   path.Join("testdata", "kyma-2.yaml"),
+		ignored:  "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		format:   formatArgoCD,
+	})
+	require.NoError(t, err)
+
+	var result struct {
+		Resources []argoCDResource `yaml:"resources"`
+	}
+	require.NoError(t, yaml.Unmarshal(buf.Bytes(), &result))
+	require.Equal(t, []argoCDResource{
+		{Group: "", Version: "v1", Kind: "ConfigMap", Namespace: "kyma-system", Name: "tracing-grafana-dashboard"},
+		{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor", Namespace: "kyma-system", Name: "tracing-jaeger-operator"},
+	}, result.Resources)
+	require.True(t, strings.HasPrefix(buf.String(), "resources:\n  - group: \"\"\n    version: v1\n"), buf.String())
+}
+
+func TestUnsupportedFormat(t *testing.T) {
+	err := run(bytes.NewBufferString(""), flags{fromFile: "from.yaml", toFile: "to.yaml", format: "xml"})
+	require.EqualError(t, err, "unsupported format: xml")
+}
+
+func TestEmptyNameSkipped(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ""
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+	output := path.Join(dir, "cleanup.sh")
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "WARN - skipping ConfigMap with empty metadata.name\n")
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps foo
+`, string(content))
+}
+
+func TestEmitHeaderEnv(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:      path.Join("testdata", "kyma-1.yaml"),
+		toFile:        path.Join("testdata", "kyma-2.yaml"),
+		ignored:       "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		outputFile:    output,
+		emitHeaderEnv: true,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+NAMESPACE="${NAMESPACE:-kyma-system}"
+
+kubectl delete -n "$NAMESPACE" configmaps tracing-grafana-dashboard
+kubectl delete -n "$NAMESPACE" servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestConflictingFlags(t *testing.T) {
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:           path.Join("testdata", "kyma-1.yaml"),
+		toFile:             path.Join("testdata", "kyma-2.yaml"),
+		parseOnly:          true,
+		outputFile:         "cleanup.sh",
+		reportFile:         "report.json",
+		includeAnnotations: true,
+	})
+	require.EqualError(t, err, `invalid flag combination:
+  -parse-only cannot be combined with -output
+  -parse-only cannot be combined with -report-file`)
+	require.NoFileExists(t, "cleanup.sh")
+}
+
+func TestAllowlist(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: istio-system
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: c
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, allowed: "configmap@kyma-system"})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps a
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, allowed: "configmap"})
+	require.EqualError(t, err, "invalid allowlist entry format: configmap")
+}
+
+func TestTableSummaryWithScript(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile:      path.Join("testdata", "kyma-1.yaml"),
+		toFile:        path.Join("testdata", "kyma-2.yaml"),
+		outputFile:    output,
+		summaryFormat: formatTable,
+	})
+	require.NoError(t, err)
+	require.Equal(t, `KIND                 NAMESPACE    NAME                                   APIVERSION                    SEVERITY
+AuthorizationPolicy  kyma-system  tracing-jaeger                         security.istio.io/v1beta1     info
+ClusterRoleBinding                cluster-essentials-pod-preset-webhook  rbac.authorization.k8s.io/v1  info
+ConfigMap            kyma-system  tracing-grafana-dashboard              v1                            info
+PodSecurityPolicy                 002-kyma-privileged                    policy/v1beta1                info
+ServiceMonitor       kyma-system  tracing-jaeger-operator                monitoring.coreos.com/v1      info
+Deletion script created: '`+output+`'
+`, buf.String())
+	require.FileExists(t, output)
+}
+
+func TestWorkloadsBeforeServices(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: foo
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+
+	tests := []struct {
+		summary                 string
+		workloadsBeforeServices bool
+		expectedOutput          string
+	}{
+		{
+			summary:                 "workloads first",
+			workloadsBeforeServices: true,
+			expectedOutput: `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system deployments.apps foo
+kubectl delete -n kyma-system services foo
+kubectl delete -n kyma-system secrets foo
+`,
+		},
+		{
+			summary: "alphabetical",
+			expectedOutput: `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system deployments.apps foo
+kubectl delete -n kyma-system secrets foo
+kubectl delete -n kyma-system services foo
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.summary, func(t *testing.T) {
+			output := path.Join(dir, "cleanup.sh")
+			err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, workloadsBeforeServices: tc.workloadsBeforeServices})
+			require.NoError(t, err)
+
+			content, err := os.ReadFile(output)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, string(content))
+		})
+	}
+
+	// kinds are matched case-insensitively
+	from = writeFile(t, dir, "lowercase.yaml", `apiVersion: v1
+kind: service
+metadata:
+  name: foo
+---
+apiVersion: apps/v1
+kind: statefulset
+metadata:
+  name: foo
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, workloadsBeforeServices: true})
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system statefulsets.apps foo
+kubectl delete -n kyma-system services foo
+`, string(content))
+}
+
+func TestNarrativeFormat(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: d
+---
+apiVersion: networking.k8s.io/v1
+kind: NetworkPolicy
+metadata:
+  name: e
+  namespace: istio-system
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: f
+`)
+
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{fromFile: from, toFile: to, format: formatNarrative})
+	require.NoError(t, err)
+	require.Equal(t, `This upgrade removes 1 NetworkPolicy from the istio-system namespace.
+This upgrade removes 3 ConfigMaps and 1 ServiceMonitor from the kyma-system namespace.
+`, buf.String())
+}
+
+func TestFromConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	// kinds are matched case-insensitively
+	configMap := writeFile(t, dir, "configmap.yaml", `apiVersion: v1
+kind: configmap
+metadata:
+  name: rendered
+data:
+  other.yaml: |
+    apiVersion: v1
+    kind: Secret
+    metadata:
+      name: unrelated
+  manifests.yaml: |
+    apiVersion: v1
+    kind: ConfigMap
+    metadata:
+      name: foo
+    ---
+    apiVersion: v1
+    kind: Service
+    metadata:
+      name: bar
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromConfigMap: configMap + "#manifests.yaml", toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps foo
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromConfigMap: configMap + "#missing", toFile: to})
+	require.EqualError(t, err, "no ConfigMap with data key 'missing' found in '"+configMap+"'")
+}
+
+func TestCreatedBefore(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: old
+  creationTimestamp: "2022-01-01T10:00:00Z"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: new
+  creationTimestamp: 2022-03-01T10:00:00Z
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unknown
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, createdBefore: "2022-02-01T00:00:00Z"})
+	require.NoError(t, err)
+
+	// resources without creation timestamp are still deleted
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps old
+kubectl delete -n kyma-system configmaps unknown
+`, string(content))
+}
+
+func TestSelectorDelete(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tracing-a
+  labels:
+    app: tracing
+    release: old
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tracing-b
+  labels:
+    app: tracing
+    release: old
+    extra: "true"
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: shared-a
+  labels:
+    app: shared
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: shared-b
+  labels:
+    app: shared
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: Secret
+metadata:
+  name: shared-c
+  labels:
+    app: shared
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, selectorDelete: true})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps -l app=tracing,release=old
+kubectl delete -n kyma-system secrets shared-a
+kubectl delete -n kyma-system secrets shared-b
+`, string(content))
+}
+
+func TestShowUnchanged(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile:      path.Join("testdata", "kyma-1.yaml"),
+		toFile:        path.Join("testdata", "kyma-2.yaml"),
+		showUnchanged: true,
+	})
+	require.NoError(t, err)
+
+	unchanged := strings.Split(strings.Split(buf.String(), "5 resources to be deleted: ")[0], "\n")
+	require.Equal(t, "Resources present in both manifests:", unchanged[0])
+	require.Len(t, unchanged, 35)
+	require.Equal(t, "{apiVersion:cert.gardener.cloud/v1alpha1 kind:Certificate name:kyma-tls-cert namespace:istio-system}", unchanged[1])
+	require.Equal(t, "{apiVersion:networking.istio.io/v1alpha3 kind:VirtualService name:tracing namespace:}", unchanged[33])
+	require.Equal(t, "", unchanged[34])
+}
+
+func TestFilterCommand(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:      path.Join("testdata", "kyma-1.yaml"),
+		toFile:        path.Join("testdata", "kyma-2.yaml"),
+		outputFile:    output,
+		filterCommand: `! grep -q '"kind":"ConfigMap"'`,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestRestoreComments(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:        path.Join("testdata", "kyma-1.yaml"),
+		toFile:          path.Join("testdata", "kyma-2.yaml"),
+		ignored:         "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		outputFile:      output,
+		restoreComments: true,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+# to restore: apply manifest for v1 ConfigMap tracing-grafana-dashboard
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+# to restore: apply manifest for monitoring.coreos.com/v1 ServiceMonitor tracing-jaeger-operator
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestResourceKeyCollision(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: example.com/v1
+kind: Config
+metadata:
+  name: mapfoo
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configs.example.com mapfoo
+`, string(content))
+}
+
+func TestEffectiveNamespaceKeys(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+  namespace: kyma-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: moved
+  namespace: istio-system
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: kyma-system
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: moved
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n istio-system configmaps moved
+`, string(content))
+}
+
+func TestCrossNamespaceResources(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: kyma-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: istio-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: kube-system
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+  namespace: kyma-system
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n istio-system configmaps config
+kubectl delete -n kube-system configmaps config
+`, string(content))
+}
+
+func TestMaxLinesPerFile(t *testing.T) {
+	dir := path.Join(t.TempDir(), "scripts")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:        path.Join("testdata", "kyma-1.yaml"),
+		toFile:          path.Join("testdata", "kyma-2.yaml"),
+		outputDir:       dir,
+		maxLinesPerFile: 2,
+	})
+	require.NoError(t, err)
+
+	expected := []string{`#!/usr/bin/env bash
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+`, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`}
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, len(expected))
+	for i, e := range expected {
+		require.Equal(t, fmt.Sprintf("cleanup-%03d.sh", i+1), files[i].Name())
+		content, err := os.ReadFile(path.Join(dir, files[i].Name()))
+		require.NoError(t, err)
+		require.Equal(t, e, string(content))
+	}
+}
+
+func TestMergeKeys(t *testing.T) {
+	buf := bytes.NewBufferString("")
+	resources, skipped, err := parseManifest(buf, path.Join("testdata", "merge-keys.yaml"), manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Zero(t, skipped)
+	require.Empty(t, buf.String())
+
+	configMap := resources[manifest.Key("", "ConfigMap", "istio-system", "tracing-config")]
+	require.Equal(t, "tracing-config", configMap.Name)
+	require.Equal(t, map[string]string{"app": "tracing"}, configMap.Labels)
+	secret := resources[manifest.Key("", "Secret", "kyma-system", "tracing-secret")]
+	require.Equal(t, "tracing-secret", secret.Name)
+	require.Equal(t, map[string]string{"app": "tracing"}, secret.Labels)
+}
+
+func TestMaxPerKind(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: d
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: e
+`)
+	output := path.Join(dir, "cleanup.sh")
+
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, maxPerKind: "configmap=2,secret=1"})
+	require.EqualError(t, err, "too many resources to be deleted, use -force to delete them anyway: configmap: 3 (limit 2)")
+	require.NoFileExists(t, output)
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, maxPerKind: "configmap=2,secret=1", force: true})
+	require.NoError(t, err)
+	require.FileExists(t, output)
+}
+
+func TestKeepList(t *testing.T) {
+	dir := t.TempDir()
+	keepList := writeFile(t, dir, "keep.txt", `# resources surviving the upgrade
+configmap/tracing-grafana-datasource
+ConfigMaps/tracing-auth-proxy-tracing-templates
+servicemonitor.monitoring.coreos.com/rafter-asyncapi-service
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		keepList:   keepList,
+		outputFile: output,
+		allowed:    "configmap@*,servicemonitor.monitoring.coreos.com@*",
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com rafter-upload-service
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestPreviewResolved(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	buf := bytes.NewBufferString("")
+	err := run(buf, flags{
+		fromFile:        path.Join("testdata", "kyma-1.yaml"),
+		toFile:          path.Join("testdata", "kyma-2.yaml"),
+		outputFile:      output,
+		context:         "prod",
+		previewResolved: true,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	script := strings.TrimPrefix(string(content), "#!/usr/bin/env bash\n\n")
+	require.Contains(t, script, "kubectl delete --context=prod -n kyma-system configmaps tracing-grafana-dashboard\n")
+	require.Contains(t, buf.String(), "Resolved deletion commands:\n"+script)
+}
+
+func TestReverse(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   path.Join("testdata", "kyma-1.yaml"),
+		toFile:     path.Join("testdata", "kyma-2.yaml"),
+		outputFile: output,
+		reverse:    true,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+`, string(content))
+}
+
+func TestFinalizers(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: plain
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: protected
+  finalizers:
+    - example.com/cleanup
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+
+	tests := []struct {
+		summary        string
+		with, without  bool
+		expectedOutput string
+	}{
+		{
+			summary: "all",
+			expectedOutput: `2 resources to be deleted: ConfigMap: 2
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:plain namespace:}
+{apiVersion:v1 kind:ConfigMap name:protected namespace:}
+Note: 1 of 2 resources to be deleted have finalizers and might get stuck in deletion
+`,
+		},
+		{
+			summary: "with finalizers",
+			with:    true,
+			expectedOutput: `1 resources to be deleted: ConfigMap: 1
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:protected namespace:}
+Note: 1 of 1 resources to be deleted have finalizers and might get stuck in deletion
+`,
+		},
+		{
+			summary: "without finalizers",
+			without: true,
+			expectedOutput: `1 resources to be deleted: ConfigMap: 1
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:plain namespace:}
+`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.summary, func(t *testing.T) {
+			buf := bytes.NewBufferString("")
+			err := run(buf, flags{fromFile: from, toFile: to, withFinalizersOnly: tc.with, withoutFinalizersOnly: tc.without})
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedOutput, buf.String())
+		})
+	}
+}
+
+func TestByUID(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  uid: 3f8e2a4c-0d2b-4a8e-9c61-5a7c7b1e9d10
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, byUID: true})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+if [ "$(kubectl get -n kyma-system configmaps a -o jsonpath='{.metadata.uid}')" = "3f8e2a4c-0d2b-4a8e-9c61-5a7c7b1e9d10" ]; then
+  kubectl delete -n kyma-system configmaps a
+fi
+# WARN - no uid recorded for ConfigMap b, deleting it without checking the uid
+kubectl delete -n kyma-system configmaps b
+`, string(content))
+}
+
+func TestIgnoreParseErrors(t *testing.T) {
+	ignored, err := parseIgnoredManifests("ConfigMap:a,:b,ConfigMap:b,Service:c:d,")
+	require.EqualError(t, err, `invalid ignored manifest format:
+  1: :b
+  3: Service:c:d
+  4: `)
+	require.Equal(t, []manifest.Ignored{{Kind: "ConfigMap", Name: "a"}, {Kind: "ConfigMap", Name: "b"}}, ignored)
+}
+
+func TestExitSummary(t *testing.T) {
+	errOut := &bytes.Buffer{}
+	stderr = errOut
+	defer func() { stderr = os.Stderr }()
+
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile:      "testdata/kyma-1.yaml",
+		toFile:        "testdata/kyma-2.yaml",
+		outputFile:    output,
+		ignored:       "configmap:tracing-grafana-dashboard",
+		summaryFormat: formatJSON,
+		exitSummary:   true,
+	})
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), `"scriptWritten"`)
+
+	var summary map[string]interface{}
+	require.NoError(t, json.Unmarshal(errOut.Bytes(), &summary))
+	require.Equal(t, map[string]interface{}{
+		"from":          float64(38),
+		"to":            float64(34),
+		"orphaned":      float64(5),
+		"toDelete":      float64(4),
+		"scriptWritten": true,
+		"output":        output,
+	}, summary)
+
+	errOut.Reset()
+	err = run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/missing.yaml", exitSummary: true})
+	require.Error(t, err)
+	require.NoError(t, json.Unmarshal(errOut.Bytes(), &summary))
+	require.Equal(t, false, summary["scriptWritten"])
+	require.Equal(t, err.Error(), summary["error"])
+}
+
+func TestAPIVersionWithoutVersion(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: monitoring.coreos.com/
+kind: ServiceMonitor
+metadata:
+  name: tracing
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	output := path.Join(dir, "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "WARN - apiVersion 'monitoring.coreos.com/' of ServiceMonitor tracing has no version, the kubectl target is derived from its group only\n")
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Contains(t, string(content), "kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing\n")
+}
+
+func TestFunctions(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: kube-public
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: c
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, functions: true})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+cleanup_kyma_system() {
+  kubectl delete -n kyma-system configmaps a
+  kubectl delete -n kyma-system secrets c
+}
+
+cleanup_kube_public() {
+  kubectl delete -n kube-public configmaps b
+}
+
+cleanup_kyma_system
+cleanup_kube_public
+`, string(content))
+}
+
+func TestValidateScript(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, validateScript: true})
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "WARN")
+
+	// a template opening an if without closing it
+	err = run(out, flags{
+		fromFile:        "testdata/kyma-1.yaml",
+		toFile:          "testdata/kyma-2.yaml",
+		outputFile:      output,
+		commandTemplate: "if {{.Command}} {{.Target}}; then",
+		validateScript:  true,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "generated script '"+output+"' has syntax errors:")
+}
+
+func TestNamespaceLabel(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  labels:
+    tenant.example.com/namespace: tenant-a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+  namespace: tenant-b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, namespaceLabel: "tenant.example.com/namespace"})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n tenant-a configmaps a
+kubectl delete -n tenant-b configmaps b
+kubectl delete -n kyma-system configmaps c
+`, string(content))
+}
+
+func TestPruneOutput(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `# all resources of the installation
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+# removed by the upgrade
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: orphan
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: kept # still needed
+  namespace: default
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: orphan
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: kept
+  namespace: default
+`)
+	pruned := path.Join(dir, "pruned.yaml")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, pruneOutput: pruned})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), fmt.Sprintf("Pruned manifest created: '%s'\n", pruned))
+
+	content, err := os.ReadFile(pruned)
+	require.NoError(t, err)
+	require.Equal(t, `# all resources of the installation
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: kept # still needed
+  namespace: default
+`, string(content))
+
+	from = writeFile(t, dir, "list.yaml", `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: kept
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: orphan
+`)
+	require.NoError(t, os.Remove(pruned))
+	err = run(out, flags{fromFile: from, toFile: to, pruneOutput: pruned})
+	require.EqualError(t, err, "unable to prune ConfigMap orphan, its document also declares resources which are kept, split it into one document per resource")
+	require.NoFileExists(t, pruned)
+
+	from = writeFile(t, dir, "array.json", `[{"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "kept"}},
+{"apiVersion": "v1", "kind": "Secret", "metadata": {"name": "orphan"}}]
+`)
+	err = run(out, flags{fromFile: from, toFile: to, pruneOutput: pruned})
+	require.EqualError(t, err, "unable to prune Secret orphan, its document also declares resources which are kept, split it into one document per resource")
+	require.NoFileExists(t, pruned)
+
+	from = writeFile(t, dir, "orphans.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: orphan
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: orphan
+`)
+	require.NoError(t, run(out, flags{fromFile: from, toFile: to, pruneOutput: pruned}))
+	content, err = os.ReadFile(pruned)
+	require.NoError(t, err)
+	require.Equal(t, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+`, string(content))
+}
+
+func TestKindsReport(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", kindsReport: true})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out.String(), `Kinds seen in the manifests:
+KIND                                                       FROM  TO
+authorizationpolicy.security.istio.io                      1     0
+certificate.cert.gardener.cloud                            1     1
+clusterrole.rbac.authorization.k8s.io                      3     3
+clusterrolebinding.rbac.authorization.k8s.io               2     1
+configmap                                                  3     2
+customresourcedefinition.apiextensions.k8s.io              3     3
+deployment.apps                                            3     3
+destinationrule.networking.istio.io                        1     1
+istiooperator.install.istio.io                             1     1
+jaeger.jaegertracing.io                                    1     1
+limitrange                                                 1     1
+mutatingwebhookconfiguration.admissionregistration.k8s.io  1     1
+peerauthentication.security.istio.io                       2     2
+podsecuritypolicy.policy                                   2     1
+priorityclass.scheduling.k8s.io                            1     1
+secret                                                     2     2
+service                                                    4     4
+serviceaccount                                             2     2
+servicemonitor.monitoring.coreos.com                       3     3
+virtualservice.networking.istio.io                         1     1
+5 resources to be deleted: AuthorizationPolicy: 1, ClusterRoleBinding: 1, ConfigMap: 1, PodSecurityPolicy: 1, ServiceMonitor: 1
+Resources to be deleted after upgrade:
+`), out.String())
+}
+
+func TestRequireLabel(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:     "testdata/kyma-1.yaml",
+		toFile:       "testdata/kyma-2.yaml",
+		outputFile:   output,
+		ignored:      "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		requireLabel: "app.kubernetes.io/managed-by=Helm",
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+if [ "$(kubectl get -n kyma-system configmaps tracing-grafana-dashboard -o jsonpath='{.metadata.labels.app\.kubernetes\.io/managed-by}')" = "Helm" ]; then
+  kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+fi
+if [ "$(kubectl get -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator -o jsonpath='{.metadata.labels.app\.kubernetes\.io/managed-by}')" = "Helm" ]; then
+  kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+fi
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, requireLabel: "managed-by"})
+	require.EqualError(t, err, "invalid required label format: managed-by")
+}
+
+func TestPreserveOrder(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: Secret
+metadata:
+  name: z
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+	sorted, err := os.ReadFile(output)
+	require.NoError(t, err)
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, preserveOrder: true})
+	require.NoError(t, err)
+	preserved, err := os.ReadFile(output)
+	require.NoError(t, err)
+
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps a
+kubectl delete -n kyma-system configmaps b
+kubectl delete -n kyma-system secrets z
+`, string(sorted))
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system secrets z
+kubectl delete -n kyma-system configmaps b
+kubectl delete -n kyma-system configmaps a
+`, string(preserved))
+
+	// -kind-priority and -workloads-before-services are enabled by default
+	from = writeFile(t, dir, "prioritized.yaml", `apiVersion: v1
+kind: Namespace
+metadata:
+  name: tracing
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: jaeger
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: jaeger
+---
+apiVersion: jaegertracing.io/v1
+kind: Jaeger
+metadata:
+  name: jaeger
+`)
+	args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-from", from, "-to", to, "-output", output, "-preserve-order"})
+	require.NoError(t, err)
+	require.NoError(t, run(bytes.NewBufferString(""), args))
+	preserved, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.Contains(t, string(preserved), `kubectl delete --ignore-not-found namespaces tracing
+kubectl delete -n kyma-system --ignore-not-found services jaeger
+kubectl delete -n kyma-system --ignore-not-found deployments.apps jaeger
+kubectl delete -n kyma-system --ignore-not-found jaegers.jaegertracing.io jaeger
+`)
+}
+
+func TestResourceNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: istio-config
+  namespace: istio-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kyma-config
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: viewer
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: legacy
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete clusterroles.rbac.authorization.k8s.io viewer
+kubectl delete -n istio-system configmaps istio-config
+kubectl delete -n kyma-system configmaps kyma-config
+kubectl delete namespaces legacy
+`, string(content))
+}
+
+func TestEmptiedNamespaces(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+  namespace: legacy
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: b
+  namespace: legacy
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+  namespace: shared
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+  namespace: shared
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: e
+  namespace: ignored
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+  namespace: shared
+`)
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, ignored: "configmap:e"})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "Namespace legacy has no resources left after the deletions, consider deleting it as well\n")
+	require.NotContains(t, out.String(), "Namespace shared")
+	require.NotContains(t, out.String(), "Namespace ignored")
+}
+
+func TestNamespaceFlag(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, namespace: "custom-ns"})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete -n custom-ns configmaps tracing-grafana-dashboard
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n custom-ns servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+}
+
+func TestOnMissingKind(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+metadata:
+  name: b
+  annotations:
+    kubectl.kubernetes.io/last-applied-configuration: '{"apiVersion":"v1","kind":"Secret","metadata":{"name":"b"}}'
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, verbose: true})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "WARN - skipping b with apiVersion v1 but no kind\n")
+	require.Contains(t, out.String(), fmt.Sprintf("Parsed 1 resources from '%s'\n", from))
+
+	out.Reset()
+	err = run(out, flags{fromFile: from, toFile: to, onMissingKind: manifest.MissingKindError})
+	require.EqualError(t, err, "resource b with apiVersion v1 has no kind")
+
+	out.Reset()
+	err = run(out, flags{fromFile: from, toFile: to, onMissingKind: manifest.MissingKindInfer})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "WARN - inferred kind Secret of b from its last applied configuration\n")
+	require.Contains(t, out.String(), "{apiVersion:v1 kind:Secret name:b namespace:}\n")
+
+	err = run(out, flags{fromFile: from, toFile: to, onMissingKind: "guess"})
+	require.EqualError(t, err, "unsupported missing kind policy: guess")
+}
+
+func TestIncompleteDocumentsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: listed
+---
+spec:
+  replicas: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  labels:
+    app: nameless
+---
+kind: ConfigMap
+metadata:
+  name: versionless
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+`)
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to})
+	require.NoError(t, err)
+	require.Equal(t, `WARN - skipping document 2: missing kind
+WARN - skipping ConfigMap: missing metadata.name
+WARN - skipping ConfigMap versionless: missing apiVersion
+2 resources to be deleted: ConfigMap: 2
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:a namespace:}
+{apiVersion:v1 kind:ConfigMap name:listed namespace:}
+`, out.String())
+}
+
+func TestNow(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+		now:        true,
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system --now configmaps tracing-grafana-dashboard
+kubectl delete -n kyma-system --now servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, now: true, gracePeriod: "0"})
+	require.EqualError(t, err, `invalid flag combination:
+  -now cannot be combined with -grace-period, it is equivalent to -grace-period=1`)
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, gracePeriod: "soon"})
+	require.EqualError(t, err, "invalid grace period, expected a non-negative number of seconds: soon")
+}
+
+func TestDeletionPassthroughFlags(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	ignored := "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged,configmap"
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:    "testdata/kyma-1.yaml",
+		toFile:      "testdata/kyma-2.yaml",
+		outputFile:  output,
+		ignored:     ignored,
+		gracePeriod: "0",
+		forceDelete: true,
+	})
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system --grace-period=0 --force servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    ignored,
+		timeout:    5 * time.Minute,
+		wait:       "true",
+	})
+	require.NoError(t, err)
+	content, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system --timeout=5m0s --wait=true servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, wait: "always"})
+	require.EqualError(t, err, "invalid wait, expected true or false: always")
+}
+
+func TestCommandTemplate(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:        "testdata/kyma-1.yaml",
+		toFile:          "testdata/kyma-2.yaml",
+		outputFile:      output,
+		ignored:         "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+		commandTemplate: "oc delete {{.Kind}}.{{.APIVersion}} {{.Name}}{{if .Namespace}} -n {{.Namespace}}{{end}}",
+	})
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+oc delete AuthorizationPolicy.security.istio.io/v1beta1 tracing-jaeger -n kyma-system
+oc delete ClusterRoleBinding.rbac.authorization.k8s.io/v1 cluster-essentials-pod-preset-webhook
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, commandTemplate: "{{.Command"})
+	require.EqualError(t, err, "invalid command template: template: command:1: unclosed action")
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, commandTemplate: "{{.Verb}}"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to render command template")
+}
+
+func TestShebang(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	for _, shebang := range []string{"#!/bin/sh", "/bin/sh"} {
+		err := run(bytes.NewBufferString(""), flags{
+			fromFile:   "testdata/kyma-1.yaml",
+			toFile:     "testdata/kyma-2.yaml",
+			outputFile: output,
+			ignored:    "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy,clusterrolebinding.rbac.authorization.k8s.io",
+			shebang:    shebang,
+			strict:     true,
+		})
+		require.NoError(t, err)
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		require.Equal(t, `#!/bin/sh
+set -eu
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+`, string(content))
+	}
+
+	err := run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, shebang: "#!/bin/sh", noShebang: true})
+	require.EqualError(t, err, `invalid flag combination:
+  -no-shebang cannot be combined with -shebang`)
+}
+
+func TestPowerShell(t *testing.T) {
+	dir := t.TempDir()
+	output := path.Join(dir, "cleanup.ps1")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+		shell:      shellPowerShell,
+		strict:     true,
+	})
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `$ErrorActionPreference = "Stop"
+$PSNativeCommandUseErrorActionPreference = $true
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputDir: dir, shell: shellPowerShell, maxLinesPerFile: 3})
+	require.NoError(t, err)
+	require.FileExists(t, path.Join(dir, "cleanup-001.ps1"))
+	require.FileExists(t, path.Join(dir, "cleanup-002.ps1"))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, shell: shellPowerShell, byUID: true})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "-shell powershell cannot be combined with -by-uid")
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, shell: shellPowerShell, shebang: "#!/bin/sh"})
+	require.EqualError(t, err, `invalid flag combination:
+  -shell powershell cannot be combined with -shebang, PowerShell scripts have no shebang`)
+
+	err = run(bytes.NewBufferString(""), flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+		shell:      shellPowerShell,
+		sleep:      1500 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	content, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+Start-Sleep -Milliseconds 1500
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, string(content))
+
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, shell: "zsh"})
+	require.EqualError(t, err, "unsupported shell: zsh")
+}
+
+func TestResourcePolicyKeep(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/resource-policy.yaml", toFile: "testdata/kyma-2.yaml"})
+	require.NoError(t, err)
+	require.Equal(t, `1 resources to be deleted: ConfigMap: 1
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:settings namespace:kyma-system}
+`, out.String())
+
+	out.Reset()
+	err = run(out, flags{fromFile: "testdata/resource-policy.yaml", toFile: "testdata/kyma-2.yaml", deleteKept: true})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "{apiVersion:v1 kind:PersistentVolumeClaim name:storage namespace:kyma-system} [critical]\n")
+}
+
+func TestOwnedResources(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/owned.yaml", toFile: "testdata/kyma-2.yaml", verbose: true})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "1 resources left after removing resources having owners\n")
+	require.Contains(t, out.String(), "{apiVersion:apps/v1 kind:Deployment name:operator namespace:kyma-system}\n")
+	require.NotContains(t, out.String(), "operator-5d9f8b7c4")
+
+	out.Reset()
+	err = run(out, flags{fromFile: "testdata/owned.yaml", toFile: "testdata/kyma-2.yaml", includeOwned: true})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "{apiVersion:apps/v1 kind:ReplicaSet name:operator-5d9f8b7c4 namespace:kyma-system}\n")
+}
+
+func TestVersionChanges(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: jaegers.jaegertracing.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: removed
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: jaegers.jaegertracing.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+`)
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to})
+	require.NoError(t, err)
+	require.Equal(t, `Resources changing their apiVersion with the upgrade:
+{apiVersion:apiextensions.k8s.io/v1beta1 kind:CustomResourceDefinition name:jaegers.jaegertracing.io namespace:} -> apiextensions.k8s.io/v1
+1 resources to be deleted: ConfigMap: 1
+Resources to be deleted after upgrade:
+{apiVersion:v1 kind:ConfigMap name:removed namespace:}
+`, out.String())
+
+	out.Reset()
+	err = run(out, flags{fromFile: from, toFile: to, format: formatJSON})
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "apiVersion with the upgrade")
+}
+
+func TestVerboseDecisions(t *testing.T) {
+	log := &bytes.Buffer{}
+	stderr = log
+	defer func() { stderr = os.Stderr }()
+
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tracing-config
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: credentials
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+`)
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, ignored: "secret", ignoreRegex: "configmap:^tracing-", verbose: true})
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "parsed from:")
+	require.Equal(t, `parsed from: configmap|kyma-system|kept
+parsed from: configmap|kyma-system|tracing-config
+parsed from: secret|kyma-system|credentials
+parsed from: service|kyma-system|removed
+parsed to: configmap|kyma-system|kept
+orphaned: configmap|kyma-system|tracing-config
+orphaned: secret|kyma-system|credentials
+orphaned: service|kyma-system|removed
+ignored: configmap|kyma-system|tracing-config by configmap:^tracing-
+ignored: secret|kyma-system|credentials by secret
+`, log.String())
+
+	log.Reset()
+	err = run(out, flags{fromFile: from, toFile: to})
+	require.NoError(t, err)
+	require.Empty(t, log.String())
+}
+
+func TestQuiet(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, quiet: true})
+	require.NoError(t, err)
+	require.Empty(t, out.String())
+	require.FileExists(t, output)
+
+	err = run(out, flags{fromFile: "testdata/kyma-2.yaml", toFile: "testdata/kyma-2.yaml", quiet: true})
+	require.NoError(t, err)
+	require.Empty(t, out.String())
+
+	err = run(out, flags{fromFile: "testdata/missing.yaml", toFile: "testdata/kyma-2.yaml", quiet: true})
+	require.Error(t, err)
+
+	err = run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", quiet: true, format: formatJSON})
+	require.EqualError(t, err, `invalid flag combination:
+  -quiet cannot be combined with -verbose, -format or -summary-format`)
+}
+
+func TestNoScriptWithoutResources(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy,clusterrolebinding.rbac.authorization.k8s.io,authorizationpolicy.security.istio.io",
+	})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "No resources left to delete, the deletion script was not created\n")
+	require.NoFileExists(t, output)
+}
+
+func TestKindCounts(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile: "testdata/kyma-1.yaml",
+		toFile:   "testdata/kyma-2.yaml",
+		ignored:  "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+	})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(out.String(), "2 resources to be deleted: AuthorizationPolicy: 1, ClusterRoleBinding: 1\nResources to be deleted after upgrade:\n"), out.String())
+}
+
+func TestDuplicateResources(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  namespace: kyma-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  namespace: kyma-system
+  labels:
+    template: overlapping
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  namespace: istio-system
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: Secret
+metadata:
+  name: unrelated
+`)
+	output := path.Join(dir, "cleanup.sh")
+	out := &bytes.Buffer{}
+	orphaned, err := runWithResult(out, flags{fromFile: from, toFile: to, outputFile: output, noShebang: true})
+	require.NoError(t, err)
+	require.Len(t, orphaned, 2)
+	require.Equal(t, 1, strings.Count(out.String(), "is declared more than once"))
+	require.Contains(t, out.String(), "WARN - ConfigMap shared in namespace kyma-system (apiVersion v1) is declared more than once, the duplicates are collapsed into the last declaration\n")
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `kubectl delete -n istio-system configmaps shared
+kubectl delete -n kyma-system configmaps shared
+`, string(content))
+}
+
+func TestSameNameInOtherNamespace(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  namespace: kyma-system
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  namespace: istio-system
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: Secret
+metadata:
+  name: unrelated
+`)
+	out := &bytes.Buffer{}
+	orphaned, err := runWithResult(out, flags{fromFile: from, toFile: to})
+	require.NoError(t, err)
+	require.Len(t, orphaned, 2)
+	require.NotContains(t, out.String(), "WARN")
+}
+
+func TestVersionInfo(t *testing.T) {
+	require.Equal(t, "migrate dev ("+runtime.Version()+")", versionInfo())
+
+	version, commit = "1.2.0", "3f2a9c1"
+	defer func() { version, commit = "dev", "" }()
+	require.Equal(t, "migrate 1.2.0 (commit 3f2a9c1, "+runtime.Version()+")", versionInfo())
+
+	args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-version"})
+	require.NoError(t, err)
+	require.True(t, args.printVersion)
+}
+
+func TestDryRun(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	for _, strategy := range []string{"client", "server"} {
+		t.Run(strategy, func(t *testing.T) {
+			err := run(bytes.NewBufferString(""), flags{
+				fromFile:   "testdata/kyma-1.yaml",
+				toFile:     "testdata/kyma-2.yaml",
+				outputFile: output,
+				ignored:    "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,podsecuritypolicy.policy:002-kyma-privileged",
+				dryRun:     strategy,
+			})
+			require.NoError(t, err)
+
+			content, err := os.ReadFile(output)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf(`#!/usr/bin/env bash
+
+kubectl delete -n kyma-system --dry-run=%[1]s configmaps tracing-grafana-dashboard
+kubectl delete -n kyma-system --dry-run=%[1]s servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, strategy), string(content))
+		})
+	}
+
+	err := run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output, dryRun: "none"})
+	require.EqualError(t, err, "unsupported dry-run strategy, expected client or server: none")
+}
+
+func TestDeleteStatefulSetPVCs(t *testing.T) {
+	dir := t.TempDir()
+	// kinds are matched case-insensitively
+	from := writeFile(t, dir, "from.yaml", `apiVersion: apps/v1
+kind: statefulset
+metadata:
+  name: db
+  namespace: data
+spec:
+  replicas: 2
+  volumeClaimTemplates:
+  - metadata:
+      name: storage
+  - metadata:
+      name: wal
+---
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: cache
+spec:
+  volumeClaimTemplates:
+  - metadata:
+      name: storage
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	output := path.Join(dir, "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, outputFile: output, deleteStatefulSetPVCs: true})
+	require.NoError(t, err)
+	require.Contains(t, out.String(), "{apiVersion:apps/v1 kind:statefulset name:db namespace:data} (2 replicas)\n")
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system statefulsets.apps cache
+kubectl delete -n kyma-system persistentvolumeclaims storage-cache-0
+kubectl delete -n data statefulsets.apps db
+kubectl delete -n data persistentvolumeclaims storage-db-0
+kubectl delete -n data persistentvolumeclaims storage-db-1
+kubectl delete -n data persistentvolumeclaims wal-db-0
+kubectl delete -n data persistentvolumeclaims wal-db-1
+`, string(content))
+}
+
+func TestDocumentsWithoutKindOrAPIVersion(t *testing.T) {
+	buf := &bytes.Buffer{}
+	resources, skipped, err := parseManifest(buf, path.Join("testdata", "incomplete.yaml"), manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Equal(t, `WARN - skipping Secret stub: missing apiVersion
+WARN - skipping numbered with apiVersion v1 but no kind
+WARN - skipping document 4: missing kind
+WARN - skipping document 5: kind [ConfigMap] is not a string
+`, buf.String())
+	require.Equal(t, 4, skipped)
+	require.Len(t, resources, 1)
+	require.Contains(t, resources, manifest.Key("", "ConfigMap", defaultNamespace, "complete"))
+}
+
+func TestReportExtras(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: foo
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	report := path.Join(dir, "report.json")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, reportFile: report})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(report)
+	require.NoError(t, err)
+	require.Equal(t, `[
+  {
+    "apiVersion": "v1",
+    "kind": "ConfigMap",
+    "name": "bar",
+    "severity": "info"
+  },
+  {
+    "apiVersion": "apps/v1",
+    "kind": "Deployment",
+    "name": "foo",
+    "extras": {
+      "replicas": "3"
+    },
+    "severity": "info"
+  }
+]
+`, string(content))
+	out := &bytes.Buffer{}
+	require.NoError(t, run(out, flags{fromFile: from, toFile: to}))
+	require.Contains(t, out.String(), "{apiVersion:apps/v1 kind:Deployment name:foo namespace:} (3 replicas)\n")
+	require.Contains(t, out.String(), "{apiVersion:v1 kind:ConfigMap name:bar namespace:}\n")
+}
+
+func TestFailOnEmpty(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:    "testdata/kyma-1.yaml",
+		toFile:      "testdata/kyma-2.yaml",
+		outputFile:  output,
+		allowed:     "configmap@kyma-system,servicemonitor.monitoring.coreos.com@kyma-system",
+		ignored:     "configmap:tracing-grafana-dashboard,servicemonitor.monitoring.coreos.com:tracing-jaeger-operator",
+		failOnEmpty: true,
+	})
+	require.EqualError(t, err, "all 5 orphaned resources were filtered out, nothing left to delete")
+	require.NoFileExists(t, output)
+
+	err = run(bytes.NewBufferString(""), flags{
+		fromFile:    "testdata/kyma-1.yaml",
+		toFile:      "testdata/kyma-2.yaml",
+		outputFile:  output,
+		allowed:     "configmap@kyma-system",
+		failOnEmpty: true,
+	})
+	require.NoError(t, err)
+	require.FileExists(t, output)
+}
+
+func TestFailOnOrphans(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile:      "testdata/kyma-1.yaml",
+		toFile:        "testdata/kyma-2.yaml",
+		outputFile:    output,
+		failOnOrphans: true,
+	})
+	require.ErrorIs(t, err, errOrphansFound)
+	require.Contains(t, out.String(), "Resources to be deleted after upgrade:")
+	require.FileExists(t, output)
+
+	err = run(bytes.NewBufferString(""), flags{
+		fromFile:      "testdata/kyma-1.yaml",
+		toFile:        "testdata/kyma-2.yaml",
+		allowed:       "secret@kyma-system",
+		failOnOrphans: true,
+	})
+	require.NoError(t, err)
+
+	err = run(bytes.NewBufferString(""), flags{
+		fromFile:      "testdata/kyma-2.yaml",
+		toFile:        "testdata/kyma-2.yaml",
+		failOnOrphans: true,
+	})
+	require.NoError(t, err)
+}
+
+func TestOutputToStdout(t *testing.T) {
+	script := &bytes.Buffer{}
+	stdout = script
+	defer func() { stdout = os.Stdout }()
+
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: "-"})
+	require.NoError(t, err)
+	require.NotContains(t, out.String(), "Deletion script created")
+	require.NoFileExists(t, "-")
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged
+kubectl delete -n kyma-system servicemonitors.monitoring.coreos.com tracing-jaeger-operator
+`, script.String())
+}
+
+func TestScriptIsExecutable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not supported on windows")
+	}
+	output := writeFile(t, t.TempDir(), "cleanup.sh", "")
+	require.NoError(t, os.Chmod(output, 0644))
+	err := run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", outputFile: output})
+	require.NoError(t, err)
+	info, err := os.Stat(output)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestRunWithResult(t *testing.T) {
+	out := &bytes.Buffer{}
+	orphaned, err := runWithResult(out, flags{
+		fromFile: "testdata/kyma-1.yaml",
+		toFile:   "testdata/kyma-2.yaml",
+		ignored:  "configmap,servicemonitor.monitoring.coreos.com",
+	})
+	require.NoError(t, err)
+	var names []string
+	for _, m := range orphaned {
+		names = append(names, m.Kind+"/"+m.Name)
+	}
+	require.Equal(t, []string{
+		"AuthorizationPolicy/tracing-jaeger",
+		"ClusterRoleBinding/cluster-essentials-pod-preset-webhook",
+		"PodSecurityPolicy/002-kyma-privileged",
+	}, names)
+	require.Contains(t, out.String(), "Resources to be deleted after upgrade:")
+
+	orphaned, err = runWithResult(out, flags{fromFile: "testdata/kyma-2.yaml", toFile: "testdata/kyma-2.yaml"})
+	require.NoError(t, err)
+	require.Empty(t, orphaned)
+}
+
+func TestJSONFormat(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile: "testdata/kyma-1.yaml",
+		toFile:   "testdata/kyma-2.yaml",
+		ignored:  "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+		format:   formatJSON,
+	})
+	require.NoError(t, err)
+	var entries []reportEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entries))
+	require.Equal(t, []reportEntry{
+		{APIVersion: "security.istio.io/v1beta1", Kind: "AuthorizationPolicy", Name: "tracing-jaeger", Namespace: "kyma-system", Severity: severityInfo},
+		{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding", Name: "cluster-essentials-pod-preset-webhook", Severity: severityInfo},
+	}, entries)
+}
+
+func TestDocumentFormatsKeepStdoutParseable(t *testing.T) {
+	log := &bytes.Buffer{}
+	stderr = log
+	defer func() { stderr = os.Stderr }()
+
+	dir := t.TempDir()
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile:      "testdata/kyma-1.yaml",
+		toFile:        "testdata/kyma-2.yaml",
+		outputFile:    path.Join(dir, "cleanup.sh"),
+		reportFile:    path.Join(dir, "report.json"),
+		kindsReport:   true,
+		showUnchanged: true,
+		format:        formatJSON,
+	})
+	require.NoError(t, err)
+	var entries []reportEntry
+	require.NoError(t, json.Unmarshal(out.Bytes(), &entries))
+	require.Len(t, entries, 5)
+	require.Contains(t, log.String(), "Deletion script created")
+	require.Contains(t, log.String(), "Report created")
+
+	for _, format := range []string{formatJSON, formatYAML} {
+		out.Reset()
+		log.Reset()
+		err = run(out, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-1.yaml", format: format})
+		require.NoError(t, err)
+		require.Equal(t, "[]\n", out.String())
+		require.Equal(t, "Manifests are equal\n", log.String())
+	}
+}
+
+func TestFormatWithAnnotations(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: removed
+  annotations:
+    owner: tracing
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+`)
+	for _, format := range []string{formatJSON, formatYAML} {
+		args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-from", from, "-to", to, "-format", format, "-include-annotations"})
+		require.NoError(t, err)
+		out := &bytes.Buffer{}
+		require.NoError(t, run(out, args))
+		require.Contains(t, out.String(), "owner")
+	}
+
+	args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-from", from, "-to", to, "-include-annotations"})
+	require.NoError(t, err)
+	require.EqualError(t, run(&bytes.Buffer{}, args), `invalid flag combination:
+  -include-annotations requires -report-file or -format json|yaml`)
+}
+
+func TestYAMLFormat(t *testing.T) {
+	out := &bytes.Buffer{}
+	err := run(out, flags{
+		fromFile: "testdata/kyma-1.yaml",
+		toFile:   "testdata/kyma-2.yaml",
+		ignored:  "configmap,servicemonitor.monitoring.coreos.com,podsecuritypolicy.policy",
+		format:   formatYAML,
+	})
+	require.NoError(t, err)
+	var entries []map[string]string
+	require.NoError(t, yaml.Unmarshal(out.Bytes(), &entries))
+	require.Equal(t, []map[string]string{
+		{"apiVersion": "security.istio.io/v1beta1", "kind": "AuthorizationPolicy", "name": "tracing-jaeger", "namespace": "kyma-system", "severity": severityInfo},
+		{"apiVersion": "rbac.authorization.k8s.io/v1", "kind": "ClusterRoleBinding", "name": "cluster-essentials-pod-preset-webhook", "severity": severityInfo},
+	}, entries)
+}
+
+func TestKindPriority(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: Namespace
+metadata:
+  name: tracing
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: jaegers.jaegertracing.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: jaeger-config
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: jaeger-operator
+---
+apiVersion: jaegertracing.io/v1
+kind: Jaeger
+metadata:
+  name: jaeger
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unrelated
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, noShebang: true, kindPriority: true})
+	require.NoError(t, err)
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `kubectl delete -n kyma-system jaegers.jaegertracing.io jaeger
+kubectl delete -n kyma-system deployments.apps jaeger-operator
+kubectl delete -n kyma-system configmaps jaeger-config
+kubectl delete customresourcedefinitions.apiextensions.k8s.io jaegers.jaegertracing.io
+kubectl delete namespaces tracing
+`, string(content))
+
+	order := writeFile(t, dir, "order.txt", "namespace\n")
+	err = run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, noShebang: true, kindPriority: true, orderFile: order})
+	require.NoError(t, err)
+	content, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(content), "kubectl delete namespaces tracing\n"))
+}
+
+func TestOptimized(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: c
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: d
+  namespace: istio-system
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: viewer
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: e
+`)
+	output := path.Join(dir, "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{fromFile: from, toFile: to, outputFile: output, optimized: true, contextMap: "istio-system=mesh"})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete clusterroles.rbac.authorization.k8s.io viewer
+ns=kyma-system
+if kubectl get namespace "$ns" >/dev/null 2>&1; then
+  kubectl delete -n "$ns" configmaps a b
+  kubectl delete -n "$ns" secrets c
+fi
+ns=istio-system
+if kubectl get --context=mesh namespace "$ns" >/dev/null 2>&1; then
+  kubectl delete --context=mesh -n "$ns" configmaps d
+fi
+`, string(content))
+}
+
+func TestSeverities(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tracings.kyma-project.io
+---
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: tracing
+---
+apiVersion: v1
+kind: PersistentVolumeClaim
+metadata:
+  name: storage
+---
+apiVersion: monitoring.coreos.com/v1
+kind: ServiceMonitor
+metadata:
+  name: tracing
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+	severities := func(f flags) map[string]string {
+		out := &bytes.Buffer{}
+		require.NoError(t, run(out, f))
+		var entries []reportEntry
+		require.NoError(t, json.Unmarshal(out.Bytes(), &entries))
+		results := make(map[string]string)
+		for _, entry := range entries {
+			results[entry.Kind] = entry.Severity
+		}
+		return results
+	}
+
+	require.Equal(t, map[string]string{
+		"ConfigMap":                severityInfo,
+		"CustomResourceDefinition": severityWarning,
+		"Namespace":                severityCritical,
+		"PersistentVolumeClaim":    severityCritical,
+		"ServiceMonitor":           severityInfo,
+	}, severities(flags{fromFile: from, toFile: to, summaryFormat: formatJSON}))
+
+	severityFile := writeFile(t, dir, "severities.yaml", `servicemonitor.monitoring.coreos.com: critical
+ConfigMap: warning
+`)
+	require.Equal(t, map[string]string{
+		"ConfigMap":                severityWarning,
+		"CustomResourceDefinition": severityWarning,
+		"Namespace":                severityCritical,
+		"PersistentVolumeClaim":    severityCritical,
+		"ServiceMonitor":           severityCritical,
+	}, severities(flags{fromFile: from, toFile: to, summaryFormat: formatJSON, severityFile: severityFile}))
+
+	out := &bytes.Buffer{}
+	require.NoError(t, run(out, flags{fromFile: from, toFile: to, severityFile: severityFile}))
+	require.Contains(t, out.String(), "{apiVersion:v1 kind:ConfigMap name:config namespace:} [warning]\n")
+	require.Contains(t, out.String(), "{apiVersion:monitoring.coreos.com/v1 kind:ServiceMonitor name:tracing namespace:} [critical]\n")
+
+	out.Reset()
+	require.NoError(t, run(out, flags{fromFile: from, toFile: to}))
+	require.Contains(t, out.String(), "{apiVersion:v1 kind:ConfigMap name:config namespace:}\n")
+}
+
+func TestIgnoreNotFound(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		arguments []string
+		expected  string
+	}{
+		{
+			arguments: nil,
+			expected:  "kubectl delete -n kyma-system --ignore-not-found configmaps tracing-grafana-dashboard\n",
+		},
+		{
+			arguments: []string{"-ignore-not-found=false"},
+			expected:  "kubectl delete -n kyma-system configmaps tracing-grafana-dashboard\n",
+		},
+	} {
+		output := path.Join(dir, "cleanup.sh")
+		arguments := append([]string{"-from", "testdata/kyma-1.yaml", "-to", "testdata/kyma-2.yaml", "-output", output}, tc.arguments...)
+		args, err := parseFlags(flag.NewFlagSet("test", flag.ContinueOnError), arguments)
+		require.NoError(t, err)
+		require.NoError(t, run(bytes.NewBufferString(""), args))
+
+		content, err := os.ReadFile(output)
+		require.NoError(t, err)
+		require.Contains(t, string(content), tc.expected)
+	}
+}
+
+func TestStrict(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	f := flags{
+		fromFile:       "testdata/kyma-1.yaml",
+		toFile:         "testdata/kyma-2.yaml",
+		outputFile:     output,
+		ignored:        "authorizationpolicy.security.istio.io:tracing-jaeger,clusterrolebinding.rbac.authorization.k8s.io:cluster-essentials-pod-preset-webhook,servicemonitor.monitoring.coreos.com:tracing-jaeger-operator",
+		strict:         true,
+		reportFailures: true,
+	}
+	require.NoError(t, run(bytes.NewBufferString(""), f))
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+set -euo pipefail
+
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard || { echo "failed to delete configmaps tracing-grafana-dashboard in namespace kyma-system" >&2; exit 1; }
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged || { echo "failed to delete podsecuritypolicies.policy 002-kyma-privileged" >&2; exit 1; }
+`, string(content))
+
+	f.strict = false
+	require.NoError(t, run(bytes.NewBufferString(""), f))
+	content, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system configmaps tracing-grafana-dashboard || echo "failed to delete configmaps tracing-grafana-dashboard in namespace kyma-system" >&2
+kubectl delete podsecuritypolicies.policy 002-kyma-privileged || echo "failed to delete podsecuritypolicies.policy 002-kyma-privileged" >&2
+`, string(content))
+}
+
+func TestResourceType(t *testing.T) {
+	for _, tc := range []struct {
+		apiVersion string
+		kind       string
+		expected   string
+	}{
+		{apiVersion: "networking.k8s.io/v1", kind: "NetworkPolicy", expected: "networkpolicies.networking.k8s.io"},
+		{apiVersion: "networking.k8s.io/v1", kind: "Ingress", expected: "ingresses.networking.k8s.io"},
+		{apiVersion: "networking.istio.io/v1beta1", kind: "Gateway", expected: "gateways.networking.istio.io"},
+		{apiVersion: "v1", kind: "Endpoints", expected: "endpoints"},
+		{apiVersion: "monitoring.coreos.com/v1", kind: "Prometheus", expected: "prometheuses.monitoring.coreos.com"},
+		{apiVersion: "example.com/v1", kind: "Box", expected: "boxes.example.com"},
+		{apiVersion: "example.com/v1", kind: "Batch", expected: "batches.example.com"},
+		{apiVersion: "v1", kind: "ConfigMap", expected: "configmaps"},
+		{apiVersion: "policy/v1beta1", kind: "PodSecurityPolicy", expected: "podsecuritypolicies.policy"},
+	} {
+		t.Run(tc.kind, func(t *testing.T) {
+			require.Equal(t, tc.expected, resourceType(manifest.Resource{APIVersion: tc.apiVersion, Kind: tc.kind}))
+		})
+	}
+}
+
+func TestMixedCaseNames(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: example.com/v1
+kind: GeneratedConfig
+metadata:
+  name: tracingBackendConfig
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c
+`)
+	for _, f := range []flags{{}, {stdinBatch: true}, {optimized: true}} {
+		f.fromFile, f.toFile, f.outputFile = from, to, path.Join(dir, "cleanup.sh")
+		require.NoError(t, run(bytes.NewBufferString(""), f))
+
+		content, err := os.ReadFile(f.outputFile)
+		require.NoError(t, err)
+		require.Contains(t, string(content), "generatedconfigs.example.com")
+		require.Contains(t, string(content), "tracingBackendConfig")
+		require.NotContains(t, string(content), "tracingbackendconfig")
+	}
+}
+
+func TestIgnoreKindOnly(t *testing.T) {
+	ignored, err := parseIgnoredManifests("configmap,servicemonitor.monitoring.coreos.com:tracing-jaeger-operator")
+	require.NoError(t, err)
+	require.Equal(t, []manifest.Ignored{{Kind: "configmap"}, {Kind: "servicemonitor.monitoring.coreos.com", Name: "tracing-jaeger-operator"}}, ignored)
+
+	buf := &bytes.Buffer{}
+	err = run(buf, flags{
+		fromFile: "testdata/kyma-1.yaml",
+		toFile:   "testdata/kyma-2.yaml",
+		ignored:  "configmap,servicemonitor.monitoring.coreos.com:tracing-jaeger-operator,podsecuritypolicy.policy:other",
+	})
+	require.NoError(t, err)
+	require.NotContains(t, buf.String(), "tracing-grafana-dashboard")
+	require.NotContains(t, buf.String(), "tracing-jaeger-operator")
+	require.Contains(t, buf.String(), "002-kyma-privileged")
+}
+
+func TestIgnoreRegex(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := run(buf, flags{
+		fromFile:    "testdata/kyma-1.yaml",
+		toFile:      "testdata/kyma-2.yaml",
+		ignoreRegex: "configmap:^tracing-.*,servicemonitor.monitoring.coreos.com:-operator$,podsecuritypolicy.policy:^kyma",
+	})
+	require.NoError(t, err)
+	require.NotContains(t, buf.String(), "tracing-grafana-dashboard")
+	require.NotContains(t, buf.String(), "tracing-jaeger-operator")
+	require.Contains(t, buf.String(), "002-kyma-privileged")
+
+	err = run(buf, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", ignoreRegex: "configmap:tracing-(["})
+	require.EqualError(t, err, "invalid ignored pattern 'configmap:tracing-([': error parsing regexp: missing closing ]: `[`")
+
+	err = run(buf, flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", ignoreRegex: "tracing-.*"})
+	require.EqualError(t, err, "invalid ignored pattern format: tracing-.*")
+}
+
+func TestIgnoreFile(t *testing.T) {
+	output := path.Join(t.TempDir(), "cleanup.sh")
+	err := run(bytes.NewBufferString(""), flags{
+		fromFile:   "testdata/kyma-1.yaml",
+		toFile:     "testdata/kyma-2.yaml",
+		outputFile: output,
+		ignored:    "podsecuritypolicy.policy:002-kyma-privileged",
+		ignoreFile: path.Join("testdata", "ignore.txt"),
+	})
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+kubectl delete -n kyma-system authorizationpolicies.security.istio.io tracing-jaeger
+kubectl delete clusterrolebindings.rbac.authorization.k8s.io cluster-essentials-pod-preset-webhook
+`, string(content))
+
+	invalid := writeFile(t, t.TempDir(), "ignore.txt", "configmap:foo\nservice:bar:baz\n")
+	err = run(bytes.NewBufferString(""), flags{fromFile: "testdata/kyma-1.yaml", toFile: "testdata/kyma-2.yaml", ignoreFile: invalid})
+	require.EqualError(t, err, fmt.Sprintf(`line 2 of ignore file '%s': invalid ignored manifest format:
+  0: service:bar:baz`, invalid))
+}
+
+func TestApplyOutput(t *testing.T) {
+	dir := t.TempDir()
+	from := writeFile(t, dir, "from.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: kept
+---
+# introduced by the upgrade
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+data:
+  key: value
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: viewer
+`)
+	output := path.Join(dir, "apply.sh")
+	out := &bytes.Buffer{}
+	err := run(out, flags{fromFile: from, toFile: to, applyOutput: output})
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprintf("Apply script created: '%s'\nManifests are equal\n", output), out.String())
+
+	content, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, `#!/usr/bin/env bash
+
+# added: v1 ConfigMap added
+kubectl apply -n kyma-system -f - <<'MANIFEST'
+# introduced by the upgrade
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: added
+data:
+  key: value
+MANIFEST
+# added: rbac.authorization.k8s.io/v1 ClusterRole viewer
+kubectl apply -f - <<'MANIFEST'
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: viewer
+MANIFEST
+`, string(content))
+}
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := path.Join(dir, name)
+	require.NoError(t, os.WriteFile(p, []byte(content), 0600))
+	return p
+}
@@ -0,0 +1,683 @@
+// Package manifest parses the Kubernetes manifests of two installations and compares the
+// resources they declare, to find the resources left behind by an upgrade.
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Resource identifies a resource declared by a manifest, along with the metadata used to
+// select and order its deletion.
+type Resource struct {
+	APIVersion  string
+	Kind        string
+	Name        string
+	Namespace   string
+	Annotations map[string]string
+	Labels      map[string]string
+	Finalizers  []string
+	UID         string
+
+	// Owners lists the kind/name of the owner references, resources having owners are
+	// garbage collected by Kubernetes
+	Owners []string
+
+	// Index is the position of the document declaring the resource
+	Index int
+
+	// Extras holds a few spec fields of common kinds, like the replicas of workloads,
+	// which help reviewing the resources to be deleted
+	Extras map[string]string
+
+	// Replicas and ClaimTemplates are only captured for StatefulSets
+	Replicas       int
+	ClaimTemplates []string
+	Created        time.Time
+}
+
+func (m Resource) String() string {
+	return fmt.Sprintf("{apiVersion:%s kind:%s name:%s namespace:%s}", m.APIVersion, m.Kind, m.Name, m.Namespace)
+}
+
+// Ignored selects the resources of a kind, qualified by its group like SimpleKind, to be
+// left out of the comparison. An empty name selects all resources of the kind.
+type Ignored struct {
+	Kind string
+	Name string
+}
+
+// IgnoredPattern selects the resources of a kind whose names match a pattern.
+type IgnoredPattern struct {
+	Kind string
+	Name *regexp.Regexp
+}
+
+// Policies for documents having an apiVersion but no kind.
+const (
+	MissingKindSkip  = "skip"
+	MissingKindError = "error"
+	MissingKindInfer = "infer"
+)
+
+// Options configure Diff.
+type Options struct {
+	// Ignored and IgnoredPatterns select the orphaned resources to be left out of the result
+	Ignored         []Ignored
+	IgnoredPatterns []IgnoredPattern
+
+	// OnMissingKind is the policy for documents having an apiVersion but no kind,
+	// MissingKindSkip if empty
+	OnMissingKind string
+
+	// DefaultNamespace is the namespace of the namespaced resources not declaring one
+	DefaultNamespace string
+
+	// Warnings receives the warnings about skipped documents, they are dropped if nil
+	Warnings io.Writer
+}
+
+// Diff returns the resources declared by the from manifests which are not part of the to
+// manifests, i.e. the resources orphaned by an upgrade, sorted by kind, name and namespace.
+func Diff(from, to io.Reader, opts Options) ([]Resource, error) {
+	warnings := opts.Warnings
+	if warnings == nil {
+		warnings = io.Discard
+	}
+	var parsed [2]map[string]Resource
+	for i, r := range []io.Reader{from, to} {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifests: %v", err)
+		}
+		parsed[i], _, err = Parse(warnings, string(content), opts.OnMissingKind, opts.DefaultNamespace)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return RemoveIgnored(Compare(parsed[0], parsed[1]), opts.Ignored, opts.IgnoredPatterns), nil
+}
+
+// Parse returns the resources of a multi-document YAML stream, or of JSON objects, keyed by
+// ResourceKey, along with the number of documents which had to be skipped. The items of List
+// documents are returned as resources of their own. Warnings about skipped documents are
+// written to out.
+func Parse(out io.Writer, installManifestsYAML, onMissingKind, defaultNamespace string) (map[string]Resource, int, error) {
+	manifestsSlice, skipped, err := unmarshal(out, installManifestsYAML)
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to parse manifests: %v", err)
+	}
+	results := make(map[string]Resource)
+	for i, m := range manifestsSlice {
+		if hasUnresolvedMergeKey(m) {
+			fmt.Fprintf(out, "WARN - unresolved YAML merge key in %v, identity fields might be read incorrectly\n", m["kind"])
+		}
+		if _, found := m["kind"].(string); !found && m["apiVersion"] != nil {
+			kind, err := resolveMissingKind(out, m, onMissingKind)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(kind) == 0 {
+				skipped++
+				continue
+			}
+			m["kind"] = kind
+		}
+		kind, err := getKind(m)
+		if err != nil {
+			fmt.Fprintf(out, "WARN - skipping document %d: %v\n", i+1, err)
+			skipped++
+			continue
+		}
+		kind = canonicalKind(kind)
+		name, err := getName(m)
+		if err != nil {
+			fmt.Fprintf(out, "WARN - skipping %s: %v\n", kind, err)
+			skipped++
+			continue
+		}
+		if len(name) == 0 {
+			fmt.Fprintf(out, "WARN - skipping %s with empty metadata.name\n", kind)
+			skipped++
+			continue
+		}
+		apiVersion, err := getAPIVersion(m)
+		if err != nil {
+			fmt.Fprintf(out, "WARN - skipping %s %s: %v\n", kind, name, err)
+			skipped++
+			continue
+		}
+		if strings.HasSuffix(apiVersion, "/") {
+			fmt.Fprintf(out, "WARN - apiVersion '%s' of %s %s has no version, the kubectl target is derived from its group only\n", apiVersion, kind, name)
+		}
+		resource := Resource{
+			APIVersion:  apiVersion,
+			Kind:        kind,
+			Name:        name,
+			Namespace:   getNamespace(m),
+			Annotations: getAnnotations(m),
+			Labels:      getLabels(m),
+			Finalizers:  getFinalizers(m),
+			Owners:      getOwners(m),
+			UID:         getUID(m),
+			Index:       i,
+			Created:     getCreationTimestamp(m),
+			Extras:      getExtras(m, kind),
+		}
+		if strings.EqualFold(kind, "StatefulSet") {
+			resource.Replicas, resource.ClaimTemplates = getReplicas(m), getClaimTemplates(m)
+		}
+		key := ResourceKey(resource, defaultNamespace)
+		if _, found := results[key]; found {
+			location := name
+			if namespace := EffectiveNamespace(resource, defaultNamespace); len(namespace) > 0 {
+				location += " in namespace " + namespace
+			}
+			fmt.Fprintf(out, "WARN - %s %s (apiVersion %s) is declared more than once, the duplicates are collapsed into the last declaration\n", kind, location, apiVersion)
+		}
+		results[key] = resource
+	}
+	return results, skipped, nil
+}
+
+// resolveMissingKind applies the missing kind policy to a document without kind, an
+// empty kind is returned for documents to be skipped.
+func resolveMissingKind(out io.Writer, manifest map[string]interface{}, policy string) (string, error) {
+	metadata, _ := manifest["metadata"].(map[string]interface{})
+	name, _ := metadata["name"].(string)
+	switch policy {
+	case MissingKindError:
+		return "", fmt.Errorf("resource %s with apiVersion %v has no kind", name, manifest["apiVersion"])
+	case MissingKindInfer:
+		if kind := inferKind(metadata); len(kind) > 0 {
+			fmt.Fprintf(out, "WARN - inferred kind %s of %s from its last applied configuration\n", kind, name)
+			return kind, nil
+		}
+	}
+	fmt.Fprintf(out, "WARN - skipping %s with apiVersion %v but no kind\n", name, manifest["apiVersion"])
+	return "", nil
+}
+
+// inferKind returns the kind recorded in the last-applied-configuration annotation kubectl
+// apply leaves on resources, if any.
+func inferKind(metadata map[string]interface{}) string {
+	annotations, _ := metadata["annotations"].(map[string]interface{})
+	lastApplied, _ := annotations["kubectl.kubernetes.io/last-applied-configuration"].(string)
+	var configuration struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal([]byte(lastApplied), &configuration); err != nil {
+		return ""
+	}
+	return configuration.Kind
+}
+
+// normalizeMaps converts the map[interface{}]interface{} values yaml.v3 produces for maps
+// resolved from merge keys into map[string]interface{}, and JSON numbers into the ints and
+// floats yaml.v3 decodes numbers to.
+func normalizeMaps(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return int(i)
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeMaps(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			result[fmt.Sprint(key)] = normalizeMaps(item)
+		}
+		return result
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeMaps(item)
+		}
+		return v
+	}
+	return value
+}
+
+// hasUnresolvedMergeKey reports whether a '<<' merge key was left in the manifest or its
+// metadata instead of being merged by the decoder.
+func hasUnresolvedMergeKey(manifest map[string]interface{}) bool {
+	if _, found := manifest["<<"]; found {
+		return true
+	}
+	metadata, _ := manifest["metadata"].(map[string]interface{})
+	_, found := metadata["<<"]
+	return found
+}
+
+// canonicalKind strips a group suffix from kinds written in their fully-qualified
+// form (e.g. "Ingress.networking.k8s.io"), the group is taken from the apiVersion instead.
+func canonicalKind(kind string) string {
+	if i := strings.Index(kind, "."); i > 0 {
+		return kind[:i]
+	}
+	return kind
+}
+
+// Key identifies a resource by its kind qualified by its API group, independently of how the
+// kind is spelled and of the version of the API. The parts are separated, so e.g. kind
+// "Config" with name "Mapfoo" doesn't collide with ConfigMap "foo".
+func Key(group, kind, namespace, name string) string {
+	kind = strings.ToLower(kind)
+	if len(group) > 0 {
+		kind += "." + strings.ToLower(group)
+	}
+	return kind + "|" + namespace + "|" + name
+}
+
+// Group returns the API group of an apiVersion, which is empty for the core group.
+func Group(apiVersion string) string {
+	if i := strings.Index(apiVersion, "/"); i >= 0 {
+		return apiVersion[:i]
+	}
+	return ""
+}
+
+// ResourceKey returns the Key of a resource in the namespace it is created in, so resources
+// relying on the default namespace match those declaring it.
+func ResourceKey(m Resource, defaultNamespace string) string {
+	return Key(Group(m.APIVersion), m.Kind, EffectiveNamespace(m, defaultNamespace), m.Name)
+}
+
+// EffectiveNamespace returns the namespace a resource is created in, the default namespace
+// if it declares none and an empty namespace for cluster-scoped resources.
+func EffectiveNamespace(m Resource, defaultNamespace string) string {
+	if clusterScopedKinds[SimpleKind(m)] {
+		return ""
+	}
+	if len(m.Namespace) == 0 {
+		return defaultNamespace
+	}
+	return m.Namespace
+}
+
+// clusterScopedKinds are the built-in kinds, qualified by their group, whose resources
+// don't belong to a namespace.
+var clusterScopedKinds = map[string]bool{
+	"apiservice.apiregistration.k8s.io":                         true,
+	"certificatesigningrequest.certificates.k8s.io":             true,
+	"clusterrole.rbac.authorization.k8s.io":                     true,
+	"clusterrolebinding.rbac.authorization.k8s.io":              true,
+	"csidriver.storage.k8s.io":                                  true,
+	"csinode.storage.k8s.io":                                    true,
+	"customresourcedefinition.apiextensions.k8s.io":             true,
+	"ingressclass.networking.k8s.io":                            true,
+	"mutatingwebhookconfiguration.admissionregistration.k8s.io": true,
+	"namespace":                       true,
+	"node":                            true,
+	"persistentvolume":                true,
+	"podsecuritypolicy.policy":        true,
+	"priorityclass.scheduling.k8s.io": true,
+	"runtimeclass.node.k8s.io":        true,
+	"storageclass.storage.k8s.io":     true,
+	"validatingwebhookconfiguration.admissionregistration.k8s.io": true,
+	"volumeattachment.storage.k8s.io":                             true,
+}
+
+func unmarshal(out io.Writer, manifests string) ([]map[string]interface{}, int, error) {
+	if trimmed := strings.TrimSpace(manifests); strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		// YAML flow style starts alike, it is decoded as YAML if it is no valid JSON
+		if results, skipped, err := unmarshalJSON(out, manifests); err == nil {
+			return results, skipped, nil
+		}
+	}
+	var results []map[string]interface{}
+	var skipped int
+	decoder := yaml.NewDecoder(strings.NewReader(manifests))
+	for {
+		manifestYaml := make(map[string]interface{})
+		err := decoder.Decode(&manifestYaml)
+		if manifestYaml == nil {
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var typeError *yaml.TypeError
+		if errors.As(err, &typeError) {
+			fmt.Fprintf(out, "WARN - type error: %v\n", err)
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to decode manifest to yaml: %v", err)
+		}
+		items, invalid := expandList(out, normalizeMaps(manifestYaml).(map[string]interface{}))
+		results = append(results, items...)
+		skipped += invalid
+	}
+	return results, skipped, nil
+}
+
+// unmarshalJSON decodes a stream of JSON objects or arrays of objects, as written by
+// kubectl get -o json.
+func unmarshalJSON(out io.Writer, manifests string) ([]map[string]interface{}, int, error) {
+	var results []map[string]interface{}
+	var skipped int
+	decoder := json.NewDecoder(strings.NewReader(manifests))
+	decoder.UseNumber()
+	for {
+		var value interface{}
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("unable to decode manifest from json: %v", err)
+		}
+		values, isArray := value.([]interface{})
+		if !isArray {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			manifest, ok := normalizeMaps(v).(map[string]interface{})
+			if !ok {
+				fmt.Fprintf(out, "WARN - skipping json value %v, it is no manifest\n", v)
+				skipped++
+				continue
+			}
+			items, invalid := expandList(out, manifest)
+			results = append(results, items...)
+			skipped += invalid
+		}
+	}
+	return results, skipped, nil
+}
+
+// expandList returns the items of a List document, like kind List or ConfigMapList, as
+// individual manifests along with the number of items which are no manifests. Other
+// documents are returned as they are.
+func expandList(out io.Writer, manifest map[string]interface{}) ([]map[string]interface{}, int) {
+	kind, _ := manifest["kind"].(string)
+	items, ok := manifest["items"].([]interface{})
+	if !strings.HasSuffix(kind, "List") || !ok {
+		return []map[string]interface{}{manifest}, 0
+	}
+	var results []map[string]interface{}
+	var skipped int
+	for i, item := range items {
+		itemManifest, ok := item.(map[string]interface{})
+		if !ok {
+			fmt.Fprintf(out, "WARN - skipping item %d of %s, it is no manifest\n", i+1, kind)
+			skipped++
+			continue
+		}
+		expanded, invalid := expandList(out, itemManifest)
+		results = append(results, expanded...)
+		skipped += invalid
+	}
+	return results, skipped
+}
+
+func getAPIVersion(manifest map[string]interface{}) (string, error) {
+	apiVersion, ok := manifest["apiVersion"].(string)
+	if !ok && manifest["apiVersion"] != nil {
+		return "", fmt.Errorf("apiVersion %v is not a string", manifest["apiVersion"])
+	}
+	if !ok {
+		return "", errors.New("missing apiVersion")
+	}
+	return apiVersion, nil
+}
+
+func getKind(manifest map[string]interface{}) (string, error) {
+	kind, ok := manifest["kind"].(string)
+	if !ok && manifest["kind"] != nil {
+		return "", fmt.Errorf("kind %v is not a string", manifest["kind"])
+	}
+	if !ok {
+		return "", errors.New("missing kind")
+	}
+	return kind, nil
+}
+
+func getName(manifest map[string]interface{}) (string, error) {
+	metadata, ok := manifest["metadata"].(map[string]interface{})
+	if !ok {
+		return "", errors.New("missing metadata")
+	}
+	name, ok := metadata["name"].(string)
+	if !ok {
+		return "", errors.New("missing metadata.name")
+	}
+	return name, nil
+}
+
+func getNamespace(manifest map[string]interface{}) string {
+	namespace, _ := manifest["metadata"].(map[string]interface{})["namespace"].(string)
+	return namespace
+}
+
+func getAnnotations(manifest map[string]interface{}) map[string]string {
+	return getStringMap(manifest, "annotations")
+}
+
+func getLabels(manifest map[string]interface{}) map[string]string {
+	return getStringMap(manifest, "labels")
+}
+
+func getStringMap(manifest map[string]interface{}, field string) map[string]string {
+	values, _ := manifest["metadata"].(map[string]interface{})[field].(map[string]interface{})
+	if len(values) == 0 {
+		return nil
+	}
+	results := make(map[string]string, len(values))
+	for k, v := range values {
+		results[k] = fmt.Sprint(v)
+	}
+	return results
+}
+
+func getUID(manifest map[string]interface{}) string {
+	uid, _ := manifest["metadata"].(map[string]interface{})["uid"].(string)
+	return uid
+}
+
+func getOwners(manifest map[string]interface{}) []string {
+	references, _ := manifest["metadata"].(map[string]interface{})["ownerReferences"].([]interface{})
+	var owners []string
+	for _, reference := range references {
+		owner, _ := reference.(map[string]interface{})
+		owners = append(owners, fmt.Sprintf("%v/%v", owner["kind"], owner["name"]))
+	}
+	return owners
+}
+
+func getFinalizers(manifest map[string]interface{}) []string {
+	finalizers, _ := manifest["metadata"].(map[string]interface{})["finalizers"].([]interface{})
+	var results []string
+	for _, f := range finalizers {
+		results = append(results, fmt.Sprint(f))
+	}
+	return results
+}
+
+// extraFields lists the spec fields captured as extras of the resources of a lowercase kind.
+var extraFields = map[string][]string{
+	"cronjob":                 {"schedule"},
+	"deployment":              {"replicas"},
+	"horizontalpodautoscaler": {"minReplicas", "maxReplicas"},
+	"replicaset":              {"replicas"},
+	"replicationcontroller":   {"replicas"},
+	"service":                 {"type"},
+	"statefulset":             {"replicas"},
+}
+
+func getExtras(manifest map[string]interface{}, kind string) map[string]string {
+	spec, _ := manifest["spec"].(map[string]interface{})
+	var extras map[string]string
+	for _, field := range extraFields[strings.ToLower(kind)] {
+		value, found := spec[field]
+		if !found || value == nil {
+			continue
+		}
+		if extras == nil {
+			extras = make(map[string]string)
+		}
+		extras[field] = fmt.Sprint(value)
+	}
+	return extras
+}
+
+// getReplicas returns spec.replicas of the manifest, defaulting to 1 like Kubernetes does.
+func getReplicas(manifest map[string]interface{}) int {
+	spec, _ := manifest["spec"].(map[string]interface{})
+	if replicas, ok := spec["replicas"].(int); ok {
+		return replicas
+	}
+	return 1
+}
+
+// getClaimTemplates returns the names of the volume claim templates of a StatefulSet.
+func getClaimTemplates(manifest map[string]interface{}) []string {
+	spec, _ := manifest["spec"].(map[string]interface{})
+	templates, _ := spec["volumeClaimTemplates"].([]interface{})
+	var names []string
+	for _, template := range templates {
+		metadata, _ := template.(map[string]interface{})["metadata"].(map[string]interface{})
+		if name, ok := metadata["name"].(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// getCreationTimestamp returns the creation timestamp of the manifest, or the zero time
+// if it has none.
+func getCreationTimestamp(manifest map[string]interface{}) time.Time {
+	switch created := manifest["metadata"].(map[string]interface{})["creationTimestamp"].(type) {
+	case time.Time:
+		return created
+	case string:
+		t, _ := time.Parse(time.RFC3339, created)
+		return t
+	}
+	return time.Time{}
+}
+
+// Compare returns the resources of left which are not part of right, sorted by kind, name
+// and namespace.
+func Compare(left, right map[string]Resource) []Resource {
+	var orphaned []Resource
+	for k, v := range left {
+		if _, found := right[k]; !found {
+			orphaned = append(orphaned, v)
+		}
+	}
+
+	sort.Slice(orphaned, func(i, j int) bool {
+		var l, r = orphaned[i], orphaned[j]
+		if l.Kind == r.Kind && l.Name == r.Name {
+			return l.Namespace < r.Namespace
+		}
+		if l.Kind == r.Kind {
+			return l.Name < r.Name
+		}
+		return l.Kind < r.Kind
+	})
+
+	return orphaned
+}
+
+// Intersect returns the resources of left which are also part of right.
+func Intersect(left, right map[string]Resource) []Resource {
+	var common []Resource
+	for k, v := range left {
+		if _, found := right[k]; found {
+			common = append(common, v)
+		}
+	}
+	sort.Slice(common, func(i, j int) bool {
+		var l, r = common[i], common[j]
+		if l.Kind == r.Kind {
+			return l.Name < r.Name
+		}
+		return l.Kind < r.Kind
+	})
+	return common
+}
+
+// VersionChange is a resource declared by both manifests, under a different apiVersion in
+// the right one.
+type VersionChange struct {
+	Resource
+	ToAPIVersion string
+}
+
+// VersionChanged returns the resources of left which are part of right under a different
+// version of the same API group, e.g. after a CustomResourceDefinition was promoted from
+// v1beta1 to v1. Kinds of other groups are different resources, see Key.
+func VersionChanged(left, right map[string]Resource) []VersionChange {
+	var changed []VersionChange
+	for k, m := range left {
+		if to, found := right[k]; found && to.APIVersion != m.APIVersion {
+			changed = append(changed, VersionChange{Resource: m, ToAPIVersion: to.APIVersion})
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool {
+		var l, r = changed[i], changed[j]
+		if l.Kind == r.Kind {
+			return l.Name < r.Name
+		}
+		return l.Kind < r.Kind
+	})
+	return changed
+}
+
+// RemoveIgnored returns the resources not selected by any of the ignored entries or
+// patterns.
+func RemoveIgnored(knvs []Resource, ignored []Ignored, patterns []IgnoredPattern) []Resource {
+	var filtered []Resource
+	for _, knv := range knvs {
+		if len(IgnoredBy(knv, ignored, patterns)) == 0 {
+			filtered = append(filtered, knv)
+		}
+	}
+	return filtered
+}
+
+// IgnoredBy returns the first ignored entry or pattern selecting the resource, written as
+// kind:name or kind:pattern, or an empty string if the resource is not ignored.
+func IgnoredBy(found Resource, ignored []Ignored, patterns []IgnoredPattern) string {
+	for _, i := range ignored {
+		if i.Kind == SimpleKind(found) && (len(i.Name) == 0 || i.Name == found.Name) {
+			if len(i.Name) == 0 {
+				return i.Kind
+			}
+			return i.Kind + ":" + i.Name
+		}
+	}
+	for _, p := range patterns {
+		if p.Kind == SimpleKind(found) && p.Name.MatchString(found.Name) {
+			return p.Kind + ":" + p.Name.String()
+		}
+	}
+	return ""
+}
+
+// SimpleKind returns the lowercase kind of the resource qualified by its API group, e.g.
+// "servicemonitor.monitoring.coreos.com", core kinds are left unqualified.
+func SimpleKind(m Resource) string {
+	kind := strings.ToLower(m.Kind)
+	if strings.Contains(m.APIVersion, "/") {
+		kind = fmt.Sprintf("%s.%s", kind, strings.ToLower(strings.Split(m.APIVersion, "/")[0]))
+	}
+	return kind
+}
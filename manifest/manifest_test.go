@@ -0,0 +1,224 @@
+package manifest
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	from, err := os.Open("../testdata/kyma-1.yaml")
+	require.NoError(t, err)
+	defer from.Close()
+	to, err := os.Open("../testdata/kyma-2.yaml")
+	require.NoError(t, err)
+	defer to.Close()
+
+	orphaned, err := Diff(from, to, Options{
+		Ignored:         []Ignored{{Kind: "configmap", Name: "tracing-grafana-dashboard"}},
+		IgnoredPatterns: []IgnoredPattern{{Kind: "podsecuritypolicy.policy", Name: regexp.MustCompile("^002-")}},
+	})
+	require.NoError(t, err)
+	var names []string
+	for _, resource := range orphaned {
+		names = append(names, resource.Kind+"/"+resource.Name)
+	}
+	require.Equal(t, []string{
+		"AuthorizationPolicy/tracing-jaeger",
+		"ClusterRoleBinding/cluster-essentials-pod-preset-webhook",
+		"ServiceMonitor/tracing-jaeger-operator",
+	}, names)
+	require.Equal(t, "security.istio.io/v1beta1", orphaned[0].APIVersion)
+	require.Equal(t, "kyma-system", orphaned[0].Namespace)
+}
+
+func TestDiffWarnings(t *testing.T) {
+	warnings := &bytes.Buffer{}
+	orphaned, err := Diff(strings.NewReader(`apiVersion: v1
+metadata:
+  name: without-kind
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: removed
+`), strings.NewReader(""), Options{Warnings: warnings})
+	require.NoError(t, err)
+	require.Len(t, orphaned, 1)
+	require.Equal(t, Key("", "ConfigMap", "", "removed"), Key(Group(orphaned[0].APIVersion), orphaned[0].Kind, orphaned[0].Namespace, orphaned[0].Name))
+	require.Equal(t, "WARN - skipping without-kind with apiVersion v1 but no kind\n", warnings.String())
+
+	_, err = Diff(strings.NewReader("apiVersion: v1\nmetadata:\n  name: without-kind\n"), strings.NewReader(""), Options{OnMissingKind: MissingKindError})
+	require.EqualError(t, err, "resource without-kind with apiVersion v1 has no kind")
+}
+
+func TestDiffDefaultNamespace(t *testing.T) {
+	from := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+  namespace: kyma-system
+`
+	to := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: foo
+  namespace: kyma-system
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: reader
+`
+	orphaned, err := Diff(strings.NewReader(from), strings.NewReader(to), Options{DefaultNamespace: "kyma-system"})
+	require.NoError(t, err)
+	require.Empty(t, orphaned)
+
+	orphaned, err = Diff(strings.NewReader(from), strings.NewReader(to), Options{DefaultNamespace: "default"})
+	require.NoError(t, err)
+	require.Len(t, orphaned, 1)
+	require.Equal(t, "foo", orphaned[0].Name)
+}
+
+func TestDiffKindsOfDifferentGroups(t *testing.T) {
+	from := `apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: foo
+  namespace: kyma-system
+---
+apiVersion: networking.internal.knative.dev/v1alpha1
+kind: Certificate
+metadata:
+  name: foo
+  namespace: kyma-system
+`
+	to := `apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: foo
+  namespace: kyma-system
+`
+	orphaned, err := Diff(strings.NewReader(from), strings.NewReader(to), Options{})
+	require.NoError(t, err)
+	require.Len(t, orphaned, 1)
+	require.Equal(t, "networking.internal.knative.dev/v1alpha1", orphaned[0].APIVersion)
+}
+
+func TestParseDuplicates(t *testing.T) {
+	certificates := `apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: foo
+---
+apiVersion: networking.internal.knative.dev/v1alpha1
+kind: Certificate
+metadata:
+  name: foo
+`
+	warnings := &bytes.Buffer{}
+	resources, _, err := Parse(warnings, certificates, MissingKindSkip, "kyma-system")
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	require.Empty(t, warnings.String())
+
+	resources, _, err = Parse(warnings, certificates+"---\n"+certificates, MissingKindSkip, "kyma-system")
+	require.NoError(t, err)
+	require.Len(t, resources, 2)
+	require.Equal(t, `WARN - Certificate foo in namespace kyma-system (apiVersion cert-manager.io/v1) is declared more than once, the duplicates are collapsed into the last declaration
+WARN - Certificate foo in namespace kyma-system (apiVersion networking.internal.knative.dev/v1alpha1) is declared more than once, the duplicates are collapsed into the last declaration
+`, warnings.String())
+}
+
+func TestParseList(t *testing.T) {
+	content, err := os.ReadFile("../testdata/list.yaml")
+	require.NoError(t, err)
+	warnings := &bytes.Buffer{}
+	resources, skipped, err := Parse(warnings, string(content), MissingKindSkip, "")
+	require.NoError(t, err)
+	require.Equal(t, 1, skipped)
+	require.Equal(t, "WARN - skipping item 3 of List, it is no manifest\n", warnings.String())
+	require.Len(t, resources, 4)
+	require.Contains(t, resources, Key("", "ConfigMap", "kyma-system", "listed-config"))
+	require.Contains(t, resources, Key("", "Secret", "kyma-system", "listed-secret"))
+	require.Contains(t, resources, Key("", "ConfigMap", "istio-system", "nested-config"))
+	require.Contains(t, resources, Key("", "ServiceAccount", "", "standalone"))
+}
+
+func TestVersionChanged(t *testing.T) {
+	left, _, err := Parse(io.Discard, `apiVersion: apiextensions.k8s.io/v1beta1
+kind: CustomResourceDefinition
+metadata:
+  name: jaegers.jaegertracing.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+`, MissingKindSkip, "")
+	require.NoError(t, err)
+	right, _, err := Parse(io.Discard, `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: jaegers.jaegertracing.io
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+`, MissingKindSkip, "")
+	require.NoError(t, err)
+
+	changed := VersionChanged(left, right)
+	require.Len(t, changed, 1)
+	require.Equal(t, "jaegers.jaegertracing.io", changed[0].Name)
+	require.Equal(t, "apiextensions.k8s.io/v1beta1", changed[0].APIVersion)
+	require.Equal(t, "apiextensions.k8s.io/v1", changed[0].ToAPIVersion)
+	require.Empty(t, Compare(left, right))
+
+	left, _, err = Parse(io.Discard, `apiVersion: networking.internal.knative.dev/v1alpha1
+kind: Certificate
+metadata:
+  name: foo
+`, MissingKindSkip, "")
+	require.NoError(t, err)
+	right, _, err = Parse(io.Discard, `apiVersion: cert-manager.io/v1
+kind: Certificate
+metadata:
+  name: foo
+`, MissingKindSkip, "")
+	require.NoError(t, err)
+	require.Empty(t, VersionChanged(left, right))
+	require.Len(t, Compare(left, right), 1)
+}
+
+func TestParseJSON(t *testing.T) {
+	content, err := os.ReadFile("../testdata/manifests.json")
+	require.NoError(t, err)
+	warnings := &bytes.Buffer{}
+	resources, skipped, err := Parse(warnings, string(content), MissingKindSkip, "")
+	require.NoError(t, err)
+	require.Equal(t, 0, skipped)
+	require.Empty(t, warnings.String())
+	require.Len(t, resources, 4)
+	require.Contains(t, resources, Key("", "ConfigMap", "kyma-system", "json-config"))
+	require.Contains(t, resources, Key("", "Service", "kyma-system", "json-service"))
+	require.Contains(t, resources, Key("", "Secret", "kyma-system", "listed-secret"))
+	statefulSet := resources[Key("apps", "StatefulSet", "kyma-system", "json-database")]
+	require.Equal(t, 3, statefulSet.Replicas)
+	require.Equal(t, map[string]string{"replicas": "3"}, statefulSet.Extras)
+
+	resources, _, err = Parse(warnings, "{apiVersion: v1, kind: ConfigMap, metadata: {name: flow-style}}", MissingKindSkip, "")
+	require.NoError(t, err)
+	require.Contains(t, resources, Key("", "ConfigMap", "", "flow-style"))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source provides the manifests of a comparison input, e.g. a file or a URL.
+type Source interface {
+	Open() (io.ReadCloser, error)
+}
+
+// stdin is read by the "-" source.
+var stdin io.Reader = os.Stdin
+
+type stdinSource struct{}
+
+func (stdinSource) Open() (io.ReadCloser, error) {
+	return io.NopCloser(stdin), nil
+}
+
+type fileSource string
+
+func (s fileSource) Open() (io.ReadCloser, error) {
+	return os.Open(string(s))
+}
+
+// httpClient fetches URL sources, the timeout keeps an unresponsive server from stalling
+// the comparison.
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+type urlSource string
+
+func (s urlSource) Open() (io.ReadCloser, error) {
+	resp, err := httpClient.Get(string(s))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// newSource returns the source of a location, URLs are recognized by their scheme and
+// "-" stands for stdin.
+func newSource(location string) Source {
+	if location == "-" {
+		return stdinSource{}
+	}
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return urlSource(location)
+	}
+	return fileSource(location)
+}
+
+// sourceLocations splits the comma separated list of sources, replacing directories by the
+// YAML and JSON files found in them recursively, in lexical order. Gzip-compressed files
+// are included as well.
+func sourceLocations(locations string) ([]string, error) {
+	var list []string
+	for _, location := range strings.Split(locations, ",") {
+		info, err := os.Stat(location)
+		if err != nil || !info.IsDir() {
+			list = append(list, location)
+			continue
+		}
+		err = filepath.WalkDir(location, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if ext := filepath.Ext(strings.TrimSuffix(path, ".gz")); !entry.IsDir() && (ext == ".yaml" || ext == ".yml" || ext == ".json") {
+				list = append(list, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to read manifest directory at '%v': %v", location, err)
+		}
+	}
+	return list, nil
+}
+
+// readSources reads the sources concurrently and returns their manifests in the order of
+// the list.
+func readSources(list []string) ([]string, error) {
+	contents := make([]string, len(list))
+	errs := make([]error, len(list))
+	var wg sync.WaitGroup
+	for i, location := range list {
+		wg.Add(1)
+		go func(i int, location string) {
+			defer wg.Done()
+			contents[i], errs[i] = readSource(newSource(location))
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("unable to read manifest file at '%v': %v", location, errs[i])
+			}
+		}(i, location)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return contents, nil
+}
+
+// readsStdin reports whether the comma separated list of sources includes stdin.
+func readsStdin(locations string) bool {
+	for _, location := range strings.Split(locations, ",") {
+		if location == "-" {
+			return true
+		}
+	}
+	return false
+}
+
+// readSource returns the manifests of the source, decompressing gzip-compressed content
+// recognized by its magic bytes.
+func readSource(source Source) (string, error) {
+	reader, err := source.Open()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+	buffered := bufio.NewReader(reader)
+	var content []byte
+	if magic, _ := buffered.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return "", err
+		}
+		content, err = io.ReadAll(decompressed)
+		if err != nil {
+			return "", err
+		}
+		return string(content), nil
+	}
+	content, err = io.ReadAll(buffered)
+	if err != nil {
+		return "", err
+	}
+	return string(content), nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"migrate/manifest"
+)
+
+func TestMixedSources(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/extra.yaml" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: served-over-http
+`)
+	}))
+	defer server.Close()
+
+	buf := &bytes.Buffer{}
+	from, _, err := parseManifest(buf, "testdata/kyma-1.yaml,"+server.URL+"/extra.yaml", manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Len(t, from, 39)
+	require.Contains(t, from, manifest.Key("", "ConfigMap", defaultNamespace, "served-over-http"))
+
+	err = run(buf, flags{fromFile: "testdata/kyma-1.yaml," + server.URL + "/extra.yaml", toFile: "testdata/kyma-2.yaml"})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "served-over-http")
+
+	_, _, err = parseManifest(buf, "testdata/kyma-1.yaml,"+server.URL+"/missing.yaml", manifest.MissingKindSkip, defaultNamespace)
+	require.EqualError(t, err, "unable to read manifest file at '"+server.URL+"/missing.yaml': unexpected status 404 Not Found")
+}
+
+func TestURLSourceTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+	httpClient = &http.Client{Timeout: 50 * time.Millisecond}
+	defer func() { httpClient = &http.Client{Timeout: 30 * time.Second} }()
+
+	_, _, err := parseManifest(&bytes.Buffer{}, server.URL+"/slow.yaml", manifest.MissingKindSkip, defaultNamespace)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unable to read manifest file at '"+server.URL+"/slow.yaml'")
+	require.Contains(t, err.Error(), "Client.Timeout exceeded")
+}
+
+func TestGzipSource(t *testing.T) {
+	content, err := os.ReadFile("testdata/kyma-1.yaml")
+	require.NoError(t, err)
+	compressed := &bytes.Buffer{}
+	w := gzip.NewWriter(compressed)
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	dir := t.TempDir()
+	withName := writeFile(t, dir, "kyma-1.yaml.gz", compressed.String())
+
+	buf := &bytes.Buffer{}
+	from, _, err := parseManifest(buf, withName, manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Len(t, from, 38)
+
+	from, _, err = parseManifest(buf, dir, manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Len(t, from, 38)
+}
+
+func TestStdinSource(t *testing.T) {
+	stdin = strings.NewReader(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: piped
+`)
+	defer func() { stdin = os.Stdin }()
+
+	buf := &bytes.Buffer{}
+	err := run(buf, flags{fromFile: "-", toFile: "testdata/kyma-2.yaml", verbose: true})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), "Parsed 1 resources from '-'\n")
+	require.Contains(t, buf.String(), "{apiVersion:v1 kind:ConfigMap name:piped namespace:}\n")
+
+	err = run(buf, flags{fromFile: "-", toFile: "testdata/kyma-2.yaml,-"})
+	require.EqualError(t, err, `invalid flag combination:
+  -from and -to cannot both read stdin`)
+}
+
+func TestMultipleFiles(t *testing.T) {
+	dir := t.TempDir()
+	crds := writeFile(t, dir, "crds.yaml", `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tracings.kyma-project.io
+`)
+	core := writeFile(t, dir, "core.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: core
+---
+apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tracings.kyma-project.io
+`)
+	to := writeFile(t, dir, "to.yaml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other
+`)
+	buf := &bytes.Buffer{}
+	err := run(buf, flags{fromFile: crds + "," + core, toFile: to, verbose: true})
+	require.NoError(t, err)
+	require.Contains(t, buf.String(), fmt.Sprintf("WARN - CustomResourceDefinition tracings.kyma-project.io of '%s' is also declared in '%s'\n", core, crds))
+	require.Contains(t, buf.String(), fmt.Sprintf("Parsed 2 resources from '%s,%s'\n", crds, core))
+	require.Contains(t, buf.String(), "Found 2 orphaned resources\n")
+}
+
+func TestDirectorySource(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "crds.yaml", `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: tracings.kyma-project.io
+`)
+	require.NoError(t, os.MkdirAll(path.Join(dir, "core", "nested"), 0755))
+	writeFile(t, path.Join(dir, "core"), "configmap.yml", `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: core
+`)
+	writeFile(t, path.Join(dir, "core", "nested"), "secret.yaml", `apiVersion: v1
+kind: Secret
+metadata:
+  name: nested
+`)
+	writeFile(t, path.Join(dir, "core"), "README.md", "# not a manifest\n")
+
+	locations, err := sourceLocations(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		path.Join(dir, "core", "configmap.yml"),
+		path.Join(dir, "core", "nested", "secret.yaml"),
+		path.Join(dir, "crds.yaml"),
+	}, locations)
+
+	buf := &bytes.Buffer{}
+	from, _, err := parseManifest(buf, dir, manifest.MissingKindSkip, defaultNamespace)
+	require.NoError(t, err)
+	require.Len(t, from, 3)
+	require.Empty(t, buf.String())
+
+	locations, err = sourceLocations("testdata/kyma-1.yaml")
+	require.NoError(t, err)
+	require.Equal(t, []string{"testdata/kyma-1.yaml"}, locations)
+}